@@ -0,0 +1,227 @@
+package link
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// contentMap indexes registered remotes by content ID so that links
+// serving identical bytes can share one cache entry.
+var contentMap sync.Map // content ID -> remote
+
+// contentKey returns the contentMap key of id for links of tenant, as
+// content is only shared within a tenant namespace.
+func contentKey(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "/" + id
+}
+
+// Canonical returns the remote whose cached data should be served for
+// remote. With deduplication enabled this is an earlier registered
+// remote with the same content, otherwise it is remote itself. Content
+// is matched on the SHA-256 computed while downloading, or on a strong
+// ETag of the same URL.
+func (f *Fs) Canonical(ctx context.Context, remote string) string {
+	if !f.dedup {
+		return remote
+	}
+	val, ok := urlMap.Load(remote)
+	if !ok {
+		return remote
+	}
+	e := val.(*entry)
+
+	// The metadata is usually reused by the lookup that follows. A change
+	// of content found by fetching it drops the alias.
+	meta, err := f.metadata(ctx, remote, e)
+	if err != nil {
+		// Serving remote will surface the error to the client
+		return remote
+	}
+
+	e.mu.Lock()
+	alias, target, sum := e.alias, e.url, e.sha256
+	e.mu.Unlock()
+	if alias != "" {
+		if _, ok := urlMap.Load(alias); ok {
+			return alias
+		}
+	}
+
+	ids := contentIDs(target, meta, sum)
+	for _, id := range ids {
+		if other, ok := contentMap.Load(contentKey(e.tenant, id)); ok && other.(string) != remote {
+			if _, ok := urlMap.Load(other.(string)); ok {
+				fs.Debugf(remote, "content matches %s (%s), serving it instead", other, id)
+				e.mu.Lock()
+				e.alias = other.(string)
+				e.mu.Unlock()
+				return other.(string)
+			}
+		}
+	}
+	for _, id := range ids {
+		contentMap.LoadOrStore(contentKey(e.tenant, id), remote)
+	}
+	return remote
+}
+
+// forgetContent drops what is known about the content of remote after
+// it changed upstream: its computed MD5, its alias, the content IDs
+// pointing at it and the aliases of other links to it.
+func forgetContent(remote string, e *entry) {
+	e.mu.Lock()
+	e.alias, e.md5, e.sha256, e.hasher = "", "", "", nil
+	e.mu.Unlock()
+	contentMap.Range(func(key, value any) bool {
+		if value.(string) == remote {
+			contentMap.CompareAndDelete(key, remote)
+		}
+		return true
+	})
+	urlMap.Range(func(key, value any) bool {
+		other := value.(*entry)
+		other.mu.Lock()
+		if other.alias == remote {
+			other.alias = ""
+		}
+		other.mu.Unlock()
+		return true
+	})
+}
+
+// streamHasher computes the MD5 and SHA-256 of a link while its content is read
+// from the upstream. The content may arrive over several Open calls as
+// long as they are sequential; out of order reads are not hashed.
+type streamHasher struct {
+	mu     sync.Mutex
+	md5    hash.Hash
+	sha256 hash.Hash
+	offset int64
+	size   int64
+}
+
+// hashingReader feeds the bytes read from the upstream into a
+// streamHasher when they continue where it left off.
+type hashingReader struct {
+	io.ReadCloser
+	hasher *streamHasher
+	offset int64
+	done   func(md5Sum, sha256Sum string)
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		var md5Sum, sha256Sum string
+		sh := r.hasher
+		sh.mu.Lock()
+		if sh.offset == r.offset {
+			_, _ = sh.md5.Write(p[:n])
+			_, _ = sh.sha256.Write(p[:n])
+			sh.offset += int64(n)
+			if sh.offset == sh.size {
+				md5Sum = hex.EncodeToString(sh.md5.Sum(nil))
+				sha256Sum = hex.EncodeToString(sh.sha256.Sum(nil))
+			}
+		}
+		sh.mu.Unlock()
+		r.offset += int64(n)
+		if md5Sum != "" {
+			r.done(md5Sum, sha256Sum)
+		}
+	}
+	return n, err
+}
+
+// hashOnRead wraps in, which returns the content of e from offset, so
+// that the MD5 and SHA-256 of the whole file are recorded once it has
+// been read.
+func (f *Fs) hashOnRead(remote string, e *entry, size, offset int64, in io.ReadCloser) io.ReadCloser {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.md5 != "" || size <= 0 {
+		return in
+	}
+	if offset == 0 {
+		e.hasher = &streamHasher{md5: md5.New(), sha256: sha256.New(), size: size}
+	}
+	if e.hasher == nil {
+		return in
+	}
+	e.hasher.mu.Lock()
+	next := e.hasher.offset
+	e.hasher.mu.Unlock()
+	if offset != next {
+		return in
+	}
+	return &hashingReader{
+		ReadCloser: in,
+		hasher:     e.hasher,
+		offset:     offset,
+		done: func(md5Sum, sha256Sum string) {
+			fs.Debugf(remote, "computed md5 %s from downloaded content", md5Sum)
+			e.mu.Lock()
+			e.md5, e.sha256 = md5Sum, sha256Sum
+			e.hasher = nil
+			e.mu.Unlock()
+			if f.dedup {
+				contentMap.LoadOrStore(contentKey(e.tenant, "sha256:"+sha256Sum), remote)
+			}
+		},
+	}
+}
+
+// Info describes a registered link for listings.
+type Info struct {
+	Remote  string    `json:"remote"`
+	Tenant  string    `json:"tenant,omitempty"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time,omitzero"`
+	Alias   string    `json:"alias,omitempty"`
+	MD5     string    `json:"md5,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Entries returns information about every registered link. Size is -1
+// for links whose metadata has not been fetched yet.
+func Entries() []Info {
+	var infos []Info
+	urlMap.Range(func(key, value any) bool {
+		e := value.(*entry)
+		e.mu.Lock()
+		info := Info{
+			Remote: key.(string),
+			Tenant: e.tenant,
+			URL:    e.url,
+			Size:   -1,
+			Alias:  e.alias,
+			MD5:    e.md5,
+		}
+		if e.meta != nil {
+			info.Size = e.meta.size
+			info.ModTime = e.meta.modTime
+		}
+		if e.err != nil {
+			info.Error = e.err.Error()
+		}
+		e.mu.Unlock()
+		infos = append(infos, info)
+		return true
+	})
+	slices.SortFunc(infos, func(a, b Info) int { return strings.Compare(a.Remote, b.Remote) })
+	return infos
+}
@@ -0,0 +1,151 @@
+package link
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs/hash"
+)
+
+var hexMD5 = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// digestHashes maps digest algorithm names to the rclone hash types
+// exposed by the backend.
+var digestHashes = map[string]hash.Type{
+	"md5":     hash.MD5,
+	"sha1":    hash.SHA1,
+	"sha-256": hash.SHA256,
+	"sha-512": hash.SHA512,
+}
+
+// digests extracts content digests advertised by the upstream in header,
+// keyed by lower case algorithm name ("md5", "sha-256", ...) with hex
+// encoded values. It understands Content-MD5, Digest (RFC 3230),
+// Repr-Digest (RFC 9530), x-goog-hash and the ETags of single part S3
+// objects.
+func digests(header http.Header) map[string]string {
+	out := make(map[string]string)
+	add := func(alg, b64 string) {
+		b64 = strings.Trim(strings.TrimSpace(b64), ":")
+		if raw, err := base64.StdEncoding.DecodeString(b64); err == nil && len(raw) > 0 {
+			out[alg] = hex.EncodeToString(raw)
+		}
+	}
+
+	if v := header.Get("Content-MD5"); v != "" {
+		add("md5", v)
+	}
+	for _, name := range []string{"Digest", "Repr-Digest", "X-Goog-Hash"} {
+		for _, v := range header.Values(name) {
+			for item := range strings.SplitSeq(v, ",") {
+				alg, val, ok := strings.Cut(strings.TrimSpace(item), "=")
+				if !ok {
+					continue
+				}
+				alg = strings.ToLower(alg)
+				if alg == "sha" {
+					alg = "sha1"
+				}
+				add(alg, val)
+			}
+		}
+	}
+	if _, ok := out["md5"]; !ok && fromS3(header) {
+		// S3 returns the MD5 as ETag unless the object was uploaded in
+		// parts, in which case the ETag contains a "-".
+		if etag := strings.Trim(header.Get("ETag"), `"`); hexMD5.MatchString(etag) {
+			out["md5"] = strings.ToLower(etag)
+		}
+	}
+	return out
+}
+
+// s3Servers are Server header values of S3 compatible stores whose
+// single part ETags are the MD5 of the content.
+var s3Servers = []string{"amazons3", "minio", "ceph", "garage", "seaweedfs"}
+
+// fromS3 returns true if header is from an S3 compatible store. Other
+// servers may use 32 hex digit ETags which are not an MD5.
+func fromS3(header http.Header) bool {
+	for name := range header {
+		if strings.HasPrefix(name, "X-Amz-") {
+			return true
+		}
+	}
+	server := strings.ToLower(header.Get("Server"))
+	for _, s := range s3Servers {
+		if strings.Contains(server, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentIDs returns identifiers which are equal for two upstream files
+// only if their content is equal. Checksums the upstream advertises are
+// not used, as any uploader to a shared host could claim another's;
+// only the SHA-256 computed while downloading holds across URLs. A
+// strong ETag identifies a version of one resource, so it only matches
+// links of the same URL, such as those registered with different key
+// headers.
+func contentIDs(target string, meta *metadata, computedSHA256 string) []string {
+	var ids []string
+	if computedSHA256 != "" {
+		ids = append(ids, "sha256:"+computedSHA256)
+	}
+	if etag := meta.header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		ids = append(ids, target+" etag:"+etag+"/"+strconv.FormatInt(meta.size, 10))
+	}
+	return ids
+}
+
+// sameContent reports whether a and b, fetched for the same link,
+// describe the same content as far as the upstream tells.
+func sameContent(a, b *metadata) bool {
+	if a.size != b.size {
+		return false
+	}
+	for _, name := range []string{"ETag", "Last-Modified"} {
+		if a.header.Get(name) != b.header.Get(name) {
+			return false
+		}
+	}
+	return maps.Equal(digests(a.header), digests(b.header))
+}
+
+// upstreamHashes returns the rclone hashes advertised in header.
+func upstreamHashes(header http.Header) map[hash.Type]string {
+	hashes := make(map[hash.Type]string)
+	for alg, sum := range digests(header) {
+		if ht, ok := digestHashes[alg]; ok {
+			hashes[ht] = sum
+		}
+	}
+	return hashes
+}
+
+// Hashes returns the known checksums of the content of remote: those
+// advertised by the upstream and, failing an upstream MD5, the MD5
+// computed while downloading.
+func Hashes(remote string) map[hash.Type]string {
+	val, ok := urlMap.Load(remote)
+	if !ok {
+		return nil
+	}
+	e := val.(*entry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	hashes := make(map[hash.Type]string)
+	if e.meta != nil {
+		hashes = upstreamHashes(e.meta.header)
+	}
+	if _, ok := hashes[hash.MD5]; !ok && e.md5 != "" {
+		hashes[hash.MD5] = e.md5
+	}
+	return hashes
+}
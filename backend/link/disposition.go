@@ -0,0 +1,60 @@
+package link
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// parseDisposition returns the disposition type and sanitized filename
+// from the Content-Disposition header, if the upstream sent one.
+func parseDisposition(header http.Header) (dispType, filename string) {
+	v := header.Get("Content-Disposition")
+	if v == "" {
+		return "", ""
+	}
+	dispType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "", ""
+	}
+	return dispType, SanitizeFilename(params["filename"])
+}
+
+// SanitizeFilename reduces name to a plain file name without directory
+// components or control characters. It returns "" if nothing is left.
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '\\' {
+			return -1
+		}
+		return r
+	}, name)
+	name = path.Base(strings.TrimSpace(name))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// maxFilename limits the length of file names taken from URLs.
+const maxFilename = 200
+
+// FilenameFromURL returns the sanitized last path element of rawURL,
+// or "" if it has none.
+func FilenameFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return ""
+	}
+	name := SanitizeFilename(path.Base(u.Path))
+	if len(name) > maxFilename {
+		ext := path.Ext(name)
+		if len(ext) > maxFilename/2 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFilename-len(ext)], "") + ext
+	}
+	return name
+}
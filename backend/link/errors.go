@@ -0,0 +1,65 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Errors describing why an upstream link could not be served. They are
+// wrapped by the errors returned from the backend so callers can match
+// them with errors.Is.
+var (
+	ErrNotFound    = errors.New("link: upstream not found")
+	ErrForbidden   = errors.New("link: upstream forbidden")
+	ErrGone        = errors.New("link: upstream gone")
+	ErrRateLimited = errors.New("link: upstream rate limited")
+	ErrTimeout     = errors.New("link: upstream timeout")
+	ErrUnknownSize = errors.New("link: unknown file size")
+	ErrUpstream    = errors.New("link: upstream error")
+)
+
+// StatusError is returned when the upstream answers with an unexpected
+// HTTP status.
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v (status %d)", e.Err, e.StatusCode)
+}
+
+func (e *StatusError) Unwrap() error { return e.Err }
+
+func statusError(code int) error {
+	var err error
+	switch code {
+	case http.StatusNotFound:
+		err = ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		err = ErrForbidden
+	case http.StatusGone:
+		err = ErrGone
+	case http.StatusTooManyRequests:
+		err = ErrRateLimited
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		err = ErrTimeout
+	default:
+		err = ErrUpstream
+	}
+	return &StatusError{StatusCode: code, Err: err}
+}
+
+// requestError classifies a transport level error from the HTTP client.
+func requestError(ctx context.Context, err error) error {
+	if ctx.Err() == context.Canceled {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrUpstream, err)
+}
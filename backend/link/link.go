@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +20,9 @@ import (
 	"github.com/rclone/rclone/fs/fshttp"
 	"github.com/rclone/rclone/fs/hash"
 	"github.com/rclone/rclone/lib/pacer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var retryErrorCodes = []int{
@@ -43,12 +48,113 @@ var (
 )
 
 type entry struct {
-	url    string
-	header http.Header
+	mu      sync.Mutex
+	url     string
+	header  http.Header
+	err     error
+	meta    *metadata
+	fetched time.Time
+	alias   string
+	name    string // sanitized file name from the URL, never changes
+	hasher  *streamHasher
+	md5     string                 // computed from the downloaded content
+	sha256  string                 // computed from the downloaded content
+	span    trace.SpanContext      // of the request which last registered the link
+	tenant  string                 // directory of the tenant namespace, never changes
+	allow   func(host string) bool // hosts redirects may lead to, nil for any
 }
 
-func Register(remote, url string, header http.Header) {
-	urlMap.Store(remote, &entry{url: url, header: header})
+// metadata describes an upstream file as returned by fetchMetadata.
+type metadata struct {
+	modTime time.Time
+	size    int64
+	header  http.Header // upstream response header
+}
+
+// metadataReuse is how long a successful metadata fetch is reused
+// instead of asking the upstream again, so that resolving a link and
+// then opening it costs a single round trip.
+const metadataReuse = 5 * time.Second
+
+func (e *entry) request() (string, http.Header) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.url, e.header
+}
+
+// Register maps remote to url, fetched with header. Upstream requests
+// for it are traced as part of the span in ctx, if any.
+func Register(ctx context.Context, remote, url string, header http.Header) {
+	register(ctx, "", remote, url, header)
+}
+
+// Register maps remote to url like the package level Register, placing
+// it in the namespace of f: links registered through a file system
+// rooted at a tenant directory are only listed below that directory.
+// A failure remembered for remote is forgotten if url or header
+// changed, so a client retrying with a fresh signed URL or credentials
+// isn't answered from the negative cache.
+func (f *Fs) Register(ctx context.Context, remote, url string, header http.Header) {
+	if register(ctx, f.root, remote, url, header) {
+		f.negCache.put(remote, nil)
+	}
+}
+
+// register maps remote to url, reporting whether an existing link was
+// changed to a different url or header. Its metadata is then fetched
+// again on next use.
+func register(ctx context.Context, tenant, remote, url string, header http.Header) bool {
+	span := trace.SpanContextFromContext(ctx)
+	val, loaded := urlMap.LoadOrStore(remote, &entry{url: url, header: header, name: FilenameFromURL(url), span: span, tenant: tenant})
+	if !loaded {
+		return false
+	}
+	e := val.(*entry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	changed := e.url != url || !maps.EqualFunc(e.header, header, slices.Equal)
+	if changed {
+		e.err = nil
+		e.fetched = time.Time{}
+	}
+	e.url = url
+	e.header = header
+	e.span = span
+	return changed
+}
+
+// AllowRedirects limits the upstream redirects followed for remote to
+// hosts for which allow returns true. It applies to the client which
+// registered the link last, as the cached file is shared.
+func AllowRedirects(remote string, allow func(host string) bool) {
+	if val, ok := urlMap.Load(remote); ok {
+		e := val.(*entry)
+		e.mu.Lock()
+		e.allow = allow
+		e.mu.Unlock()
+	}
+}
+
+// checkRedirect returns the CheckRedirect function of the client
+// fetching remote, refusing redirects to hosts it may not fetch from.
+func checkRedirect(remote string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		val, ok := urlMap.Load(remote)
+		if !ok {
+			return nil
+		}
+		e := val.(*entry)
+		e.mu.Lock()
+		allow := e.allow
+		e.mu.Unlock()
+		if allow != nil && !allow(req.URL.Hostname()) {
+			return fmt.Errorf("%w: redirect to host %s not allowed", ErrForbidden, req.URL.Hostname())
+		}
+		return nil
+	}
 }
 
 func Load(remote string) (string, bool) {
@@ -56,7 +162,21 @@ func Load(remote string) (string, bool) {
 	if !ok {
 		return "", false
 	}
-	return val.(*entry).url, true
+	url, _ := val.(*entry).request()
+	return url, true
+}
+
+// LastError returns the error from the most recent metadata fetch for
+// remote, or nil if it succeeded or has not been attempted.
+func LastError(remote string) error {
+	val, ok := urlMap.Load(remote)
+	if !ok {
+		return nil
+	}
+	e := val.(*entry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
 }
 
 func init() {
@@ -74,7 +194,11 @@ type Fs struct {
 	stripQuery  bool
 	stripDomain bool
 	shardLevel  int
+	dedup       bool
+	hashContent bool
+	keepName    bool
 	pacer       *fs.Pacer
+	negCache    negativeCache
 }
 
 func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, error) {
@@ -92,6 +216,18 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 		f.stripDomain = true
 	}
 
+	if val, ok := m.Get("dedup"); ok && val == "true" {
+		f.dedup = true
+	}
+
+	if val, ok := m.Get("hash_on_download"); ok && val == "true" {
+		f.hashContent = true
+	}
+
+	if val, ok := m.Get("keep_filename"); ok && val == "true" {
+		f.keepName = true
+	}
+
 	if val, ok := m.Get("shard_level"); ok && val != "" {
 		if level, err := strconv.Atoi(val); err == nil {
 			f.shardLevel = level
@@ -100,6 +236,20 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 		f.shardLevel = 1
 	}
 
+	for key, ttl := range map[string]*time.Duration{
+		"negative_ttl_not_found": &f.negCache.notFound,
+		"negative_ttl_forbidden": &f.negCache.forbidden,
+		"negative_ttl_error":     &f.negCache.failure,
+	} {
+		if val, ok := m.Get(key); ok && val != "" {
+			d, err := fs.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+			*ttl = d
+		}
+	}
+
 	f.features = (&fs.Features{
 		ReadMetadata: true,
 	}).Fill(ctx, f)
@@ -115,10 +265,66 @@ func (f *Fs) String() string { return "link:" }
 
 func (f *Fs) Precision() time.Duration { return time.Second }
 
-func (f *Fs) Hashes() hash.Set { return hash.Set(hash.None) }
+func (f *Fs) Hashes() hash.Set {
+	return hash.NewHashSet(hash.MD5, hash.SHA1, hash.SHA256, hash.SHA512)
+}
 
 func (f *Fs) Features() *fs.Features { return f.features }
 
+// HashOf returns the registry key of the link at the virtual path
+// remote, relative to the root of f, or an empty string if no link is
+// there. The path ends in the key itself or, with keep_filename, in the
+// key followed by the file name from the URL. The key is only taken
+// from where f puts it, so a file name equal to the key of another
+// link doesn't resolve to that link.
+func (f *Fs) HashOf(remote string) string {
+	key := path.Base(remote)
+	if f.keepName {
+		if dir := path.Dir(remote); dir != "." {
+			if val, ok := urlMap.Load(path.Base(dir)); ok && val.(*entry).name != "" {
+				key = path.Base(dir)
+			}
+		}
+	}
+	if sharded, ok := f.virtualPath(key); ok && sharded == remote {
+		if _, ok := urlMap.Load(key); ok {
+			return key
+		}
+	}
+	return ""
+}
+
+// VirtualPath returns the path of the registered link remote in the
+// file system tree, relative to the root of f.
+func (f *Fs) VirtualPath(remote string) string {
+	p, _ := f.virtualPath(remote)
+	return p
+}
+
+// virtualPath returns the path of the link remote relative to the root
+// of f and whether the link lies below the root. Links of a tenant live
+// in a directory named after it, which is the root of the tenant's file
+// system.
+func (f *Fs) virtualPath(remote string) (string, bool) {
+	sharded := ShardedPath(remote, f.shardLevel)
+	val, ok := urlMap.Load(remote)
+	if !ok {
+		return sharded, f.root == ""
+	}
+	e := val.(*entry)
+	if f.keepName && e.name != "" {
+		sharded = path.Join(sharded, e.name)
+	}
+	switch {
+	case f.root == "":
+		return path.Join(e.tenant, sharded), true
+	case e.tenant == f.root:
+		return sharded, true
+	default:
+		return sharded, false
+	}
+}
+
 func (f *Fs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
 
 	var entries fs.DirEntries
@@ -135,7 +341,10 @@ func (f *Fs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
 
 		remote := key.(string)
 
-		sharded := ShardedPath(remote, f.shardLevel)
+		sharded, ok := f.virtualPath(remote)
+		if !ok {
+			return true
+		}
 
 		objDir := path.Dir(sharded)
 
@@ -181,30 +390,96 @@ func (f *Fs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
 }
 
 func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
-	originalRemote := path.Base(remote)
+	originalRemote := f.HashOf(remote)
 	val, ok := urlMap.Load(originalRemote)
-
 	if !ok {
 		return nil, fs.ErrorObjectNotFound
 	}
 
 	e := val.(*entry)
-
-	modTime, size, err := f.fetchMetadata(ctx, e.url, e.header, originalRemote)
+	meta, err := f.metadata(ctx, originalRemote, e)
 	if err != nil {
+		fs.Debugf(remote, "metadata fetch failed: %v", err)
 		return nil, err
 	}
+	url, _ := e.request()
+	dispType, filename := parseDisposition(meta.header)
 	return &Object{
-		fs:      f,
-		remote:  remote,
-		url:     e.url,
-		size:    size,
-		modTime: modTime,
+		fs:       f,
+		remote:   remote,
+		hash:     originalRemote,
+		url:      url,
+		size:     meta.size,
+		modTime:  meta.modTime,
+		mimeType: meta.header.Get("Content-Type"),
+		dispType: dispType,
+		filename: filename,
+		hashes:   upstreamHashes(meta.header),
+		header:   meta.header,
 	}, nil
 }
 
-func (f *Fs) fetchMetadata(ctx context.Context, urlStr string, header http.Header, remote string) (time.Time, int64, error) {
+// metadata returns the upstream metadata of e, reusing a recent fetch
+// and remembering failures in the negative cache.
+func (f *Fs) metadata(ctx context.Context, remote string, e *entry) (*metadata, error) {
+	if err := f.negCache.get(remote); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	if e.meta != nil && time.Since(e.fetched) < metadataReuse {
+		meta := e.meta
+		e.mu.Unlock()
+		return meta, nil
+	}
+	url, header := e.url, e.header
+	e.mu.Unlock()
+
+	meta, err := f.fetchMetadata(e.traceContext(ctx), url, header, remote)
+
+	e.mu.Lock()
+	e.err = err
+	changed := false
+	if err == nil {
+		changed = e.meta != nil && !sameContent(e.meta, meta)
+		e.meta = meta
+		e.fetched = time.Now()
+	}
+	e.mu.Unlock()
+	f.negCache.put(remote, err)
+	if changed {
+		forgetContent(remote, e)
+	}
+	return meta, err
+}
+
+// Revalidate makes the next lookup of remote ask the upstream for its
+// metadata, ignoring a recent fetch and any remembered failure.
+func (f *Fs) Revalidate(remote string) {
+	f.negCache.put(remote, nil)
+	val, ok := urlMap.Load(remote)
+	if !ok {
+		return
+	}
+	e := val.(*entry)
+	e.mu.Lock()
+	e.fetched = time.Time{}
+	e.mu.Unlock()
+}
+
+func (f *Fs) fetchMetadata(ctx context.Context, urlStr string, header http.Header, remote string) (meta *metadata, err error) {
+	ctx, span := tracer.Start(ctx, "link.fetchMetadata", trace.WithAttributes(attribute.String("link.hash", remote)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.Int64("link.size", meta.size))
+		}
+		span.End()
+	}()
 	client := fshttp.NewClient(ctx)
+	client.CheckRedirect = checkRedirect(remote)
 
 	newReq := func(method, urlStr string) (*http.Request, error) {
 		req, err := http.NewRequestWithContext(ctx, method, urlStr, nil)
@@ -223,14 +498,10 @@ func (f *Fs) fetchMetadata(ctx context.Context, urlStr string, header http.Heade
 
 	req, err := newReq("HEAD", urlStr)
 	if err != nil {
-		return time.Time{}, 0, err
+		return nil, err
 	}
 
-	var resp *http.Response
-	err = f.pacer.Call(func() (bool, error) {
-		resp, err = client.Do(req)
-		return shouldRetry(ctx, resp, err)
-	})
+	resp, err := f.do(ctx, client, req, remote)
 
 	needFallback := err != nil || resp == nil || resp.StatusCode != http.StatusOK || resp.ContentLength < 0
 	if needFallback {
@@ -239,22 +510,19 @@ func (f *Fs) fetchMetadata(ctx context.Context, urlStr string, header http.Heade
 		}
 		req, err = newReq("GET", urlStr)
 		if err != nil {
-			return time.Time{}, 0, err
+			return nil, err
 		}
 		req.Header.Set("Range", "bytes=0-0")
-		err = f.pacer.Call(func() (bool, error) {
-			resp, err = client.Do(req)
-			return shouldRetry(ctx, resp, err)
-		})
+		resp, err = f.do(ctx, client, req, remote)
 		if err != nil {
-			return time.Time{}, 0, err
+			return nil, requestError(ctx, err)
 		}
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		return time.Time{}, 0, fmt.Errorf("metadata fetch failed: status %d", resp.StatusCode)
+		return nil, statusError(resp.StatusCode)
 	}
 
 	size := resp.ContentLength
@@ -276,10 +544,10 @@ func (f *Fs) fetchMetadata(ctx context.Context, urlStr string, header http.Heade
 	}
 
 	if size < 0 {
-		return time.Time{}, 0, fmt.Errorf("metadata fetch failed: unknown file size")
+		return nil, ErrUnknownSize
 	}
 
-	return modTime, size, nil
+	return &metadata{modTime: modTime, size: size, header: resp.Header}, nil
 }
 
 func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
@@ -292,17 +560,28 @@ func (f *Fs) Rmdir(ctx context.Context, dir string) error { return errorReadOnly
 type Object struct {
 	fs       *Fs
 	remote   string
+	hash     string // registry key of the link
 	url      string
 	size     int64
 	modTime  time.Time
 	mimeType string
+	dispType string
+	filename string
+	hashes   map[hash.Type]string
+	header   http.Header
 }
 
 func (o *Object) Fs() fs.Info    { return o.fs }
 func (o *Object) String() string { return o.remote }
 func (o *Object) Remote() string { return o.remote }
 func (o *Object) Hash(ctx context.Context, r hash.Type) (string, error) {
-	return "", hash.ErrUnsupported
+	// Only upstream supplied hashes are returned, as the VFS cache keeps
+	// them in its fingerprint and a hash appearing later on would make
+	// it discard the cached data.
+	if !o.fs.Hashes().Contains(r) {
+		return "", hash.ErrUnsupported
+	}
+	return o.hashes[r], nil
 }
 func (o *Object) Size() int64                                             { return o.size }
 func (o *Object) ModTime(ctx context.Context) time.Time                   { return o.modTime }
@@ -314,19 +593,38 @@ func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, op
 	return errorReadOnly
 }
 
+// ContentDisposition returns the disposition type and filename from the
+// upstream Content-Disposition header, or empty strings if it had none.
+func (o *Object) ContentDisposition() (dispType, filename string) {
+	return o.dispType, o.filename
+}
+
+// ResponseHeader returns the header of the upstream response the
+// metadata of the object was read from. It must not be modified.
+func (o *Object) ResponseHeader() http.Header {
+	return o.header
+}
+
 func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	originalRemote := o.hash
+	var e *entry
+	if val, ok := urlMap.Load(originalRemote); ok {
+		e = val.(*entry)
+		ctx = e.traceContext(ctx)
+	}
+
 	client := fshttp.NewClient(ctx)
+	client.CheckRedirect = checkRedirect(originalRemote)
 	req, err := http.NewRequestWithContext(ctx, "GET", o.url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Apply stored headers from urlMap dynamically
-	originalRemote := path.Base(o.remote)
-	if val, ok := urlMap.Load(originalRemote); ok {
-		e := val.(*entry)
-		if e.header != nil {
-			for k, vv := range e.header {
+	if e != nil {
+		_, header := e.request()
+		if header != nil {
+			for k, vv := range header {
 				for _, v := range vv {
 					req.Header.Set(k, v)
 				}
@@ -339,17 +637,28 @@ func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadClo
 		req.Header.Set(k, v)
 	}
 
-	var resp *http.Response
-	err = o.fs.pacer.Call(func() (bool, error) {
-		resp, err = client.Do(req)
-		return shouldRetry(ctx, resp, err)
-	})
+	resp, err := o.fs.do(ctx, client, req, originalRemote)
 	if err != nil {
-		return nil, err
+		return nil, requestError(ctx, err)
 	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		resp.Body.Close()
-		return nil, fmt.Errorf("GET failed: %s (status %d)", resp.Status, resp.StatusCode)
+		return nil, statusError(resp.StatusCode)
+	}
+
+	if e != nil && (o.fs.dedup || o.fs.hashContent) {
+		offset := int64(0)
+		for _, option := range options {
+			switch x := option.(type) {
+			case *fs.RangeOption:
+				offset, _ = x.Decode(o.size)
+			case *fs.SeekOption:
+				offset = x.Offset
+			}
+		}
+		if offset == 0 || resp.StatusCode == http.StatusPartialContent {
+			return o.fs.hashOnRead(originalRemote, e, o.size, offset, resp.Body), nil
+		}
 	}
 	return resp.Body, nil
 }
@@ -0,0 +1,444 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+)
+
+func newTestFs(t *testing.T, m configmap.Simple) *Fs {
+	t.Helper()
+	f, err := NewFs(context.Background(), "link-test", "", m)
+	if err != nil {
+		t.Fatalf("failed to create fs: %v", err)
+	}
+	return f.(*Fs)
+}
+
+func TestFetchMetadataErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusUnauthorized, ErrForbidden},
+		{http.StatusGone, ErrGone},
+		{http.StatusTeapot, ErrUpstream},
+	}
+
+	f := newTestFs(t, configmap.Simple{})
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+
+		_, err := f.fetchMetadata(context.Background(), srv.URL, nil, "test")
+		srv.Close()
+
+		if !errors.Is(err, tt.want) {
+			t.Errorf("status %d: expected %v, got %v", tt.status, tt.want, err)
+		}
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.status {
+			t.Errorf("status %d: expected StatusError with matching code, got %v", tt.status, err)
+		}
+	}
+}
+
+func TestNewObjectRecordsLastError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	f := newTestFs(t, configmap.Simple{})
+	Register(context.Background(), "lasterror", srv.URL, nil)
+
+	if _, err := f.NewObject(context.Background(), f.VirtualPath("lasterror")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden, got %v", err)
+	}
+	if err := LastError("lasterror"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected LastError to return ErrForbidden, got %v", err)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	f := newTestFs(t, configmap.Simple{"negative_ttl_not_found": "1m"})
+	Register(context.Background(), "negcache", srv.URL, nil)
+
+	for range 3 {
+		if _, err := f.NewObject(context.Background(), f.VirtualPath("negcache")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	// HEAD followed by the ranged GET fallback
+	if n := hits.Load(); n != 2 {
+		t.Errorf("expected upstream to be hit once (2 requests), got %d requests", n)
+	}
+}
+
+func TestNegativeTTLInvalid(t *testing.T) {
+	_, err := NewFs(context.Background(), "link", "", configmap.Simple{"negative_ttl_error": "5 seconds"})
+	if err == nil || !strings.Contains(err.Error(), "negative_ttl_error") {
+		t.Errorf("expected an error naming the option, got %v", err)
+	}
+}
+
+func TestRegisterForgetsFailure(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("data"))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"negative_ttl_forbidden": "1m"})
+	expired := http.Header{"Authorization": {"Bearer expired"}}
+	for range 2 {
+		f.Register(ctx, "reregister", srv.URL, expired)
+		if _, err := f.NewObject(ctx, f.VirtualPath("reregister")); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("expected ErrForbidden, got %v", err)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("expected the failure to be cached for an unchanged link, got %d requests", n)
+	}
+
+	f.Register(ctx, "reregister", srv.URL, http.Header{"Authorization": {"Bearer fresh"}})
+	if _, err := f.NewObject(ctx, f.VirtualPath("reregister")); err != nil {
+		t.Errorf("expected new credentials to be tried, got %v", err)
+	}
+	if err := LastError("reregister"); err != nil {
+		t.Errorf("expected no last error, got %v", err)
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("back again")))
+	}))
+	defer srv.Close()
+
+	f := newTestFs(t, configmap.Simple{"negative_ttl_not_found": "1m"})
+	Register(context.Background(), "revalidate", srv.URL, nil)
+	if _, err := f.NewObject(context.Background(), f.VirtualPath("revalidate")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	f.Revalidate("revalidate")
+	obj, err := f.NewObject(context.Background(), f.VirtualPath("revalidate"))
+	if err != nil || obj.Size() != int64(len("back again")) {
+		t.Fatalf("expected the remembered failure to be ignored, got %v", err)
+	}
+	f.Revalidate("revalidate")
+	if _, err := f.NewObject(context.Background(), f.VirtualPath("revalidate")); err != nil || hits.Load() != 4 {
+		t.Errorf("expected the metadata to be fetched again, got %d requests, %v", hits.Load(), err)
+	}
+}
+
+func TestCanonicalDedup(t *testing.T) {
+	content := []byte("identical bytes on every mirror")
+	contentMD5 := func(b []byte) string {
+		sum := md5.Sum(b)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	var mirrored atomic.Value
+	mirrored.Store(content)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := mirrored.Load().([]byte)
+		w.Header().Set("Content-MD5", contentMD5(body))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer mirror.Close()
+	// claimer advertises the checksum of content for other bytes
+	claimer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-MD5", contentMD5(content))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("something else")))
+	}))
+	defer claimer.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer plain.Close()
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"dedup": "true"})
+	download := func(remote string) {
+		t.Helper()
+		obj, err := f.NewObject(ctx, f.VirtualPath(remote))
+		if err != nil {
+			t.Fatalf("failed to create object: %v", err)
+		}
+		in, err := obj.Open(ctx)
+		if err != nil {
+			t.Fatalf("failed to open object: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, in); err != nil {
+			t.Fatalf("failed to read object: %v", err)
+		}
+		_ = in.Close()
+	}
+	expect := func(remote, want string) {
+		t.Helper()
+		if got := f.Canonical(ctx, remote); got != want {
+			t.Errorf("expected %s to be served as %s, got %s", remote, want, got)
+		}
+	}
+	Register(ctx, "dedup-plain", plain.URL, nil)
+	Register(ctx, "dedup-claimer", claimer.URL, nil)
+	Register(ctx, "dedup-first", mirror.URL+"/first", nil)
+	Register(ctx, "dedup-second", mirror.URL+"/second", nil)
+
+	// Advertised checksums are not trusted, not even those of the same host
+	expect("dedup-claimer", "dedup-claimer")
+	expect("dedup-first", "dedup-first")
+	expect("dedup-second", "dedup-second")
+	expect("dedup-plain", "dedup-plain")
+
+	// A downloaded checksum holds for any host
+	download("dedup-first")
+	download("dedup-plain")
+	download("dedup-second")
+	download("dedup-claimer")
+	expect("dedup-plain", "dedup-first")
+	expect("dedup-second", "dedup-first")
+	expect("dedup-claimer", "dedup-claimer")
+
+	var found bool
+	for _, info := range Entries() {
+		if info.Remote == "dedup-plain" {
+			found = true
+			if info.Alias != "dedup-first" {
+				t.Errorf("expected listing to show alias, got %+v", info)
+			}
+		}
+	}
+	if !found {
+		t.Error("dedup-plain missing from Entries")
+	}
+
+	// A change of content drops the aliases of and to the link
+	mirrored.Store([]byte("new release"))
+	f.Revalidate("dedup-first")
+	expect("dedup-first", "dedup-first")
+	for _, info := range Entries() {
+		if (info.Remote == "dedup-plain" || info.Remote == "dedup-second") && info.Alias != "" {
+			t.Errorf("expected the alias to the changed link to be dropped, got %+v", info)
+		}
+	}
+}
+
+func TestCanonicalDedupETag(t *testing.T) {
+	// Like nginx, derive the ETag from the modification time and size
+	serve := func(content string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"6630f000-5"`)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		}))
+	}
+	first, second := serve("first"), serve("other")
+	defer first.Close()
+	defer second.Close()
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"dedup": "true"})
+	Register(ctx, "etag-first", first.URL+"/file", nil)
+	Register(ctx, "etag-second", second.URL+"/file", nil)
+	Register(ctx, "etag-query", first.URL+"/file?v=2", nil)
+	Register(ctx, "etag-header", first.URL+"/file", http.Header{"Accept-Language": {"de"}})
+	for _, tt := range []struct{ remote, want string }{
+		{"etag-first", "etag-first"},
+		{"etag-second", "etag-second"},
+		{"etag-query", "etag-query"},
+		{"etag-header", "etag-first"},
+	} {
+		if got := f.Canonical(ctx, tt.remote); got != tt.want {
+			t.Errorf("expected %s to be served as %s, got %s", tt.remote, tt.want, got)
+		}
+	}
+}
+
+func TestDigestsS3ETag(t *testing.T) {
+	const etag = `"9e107d9d372bb6826bd81d3542a419d6"`
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"plain", http.Header{"Etag": {etag}}, ""},
+		{"amz", http.Header{"Etag": {etag}, "X-Amz-Request-Id": {"1"}}, "9e107d9d372bb6826bd81d3542a419d6"},
+		{"server", http.Header{"Etag": {etag}, "Server": {"MinIO"}}, "9e107d9d372bb6826bd81d3542a419d6"},
+		{"multipart", http.Header{"Etag": {`"9e107d9d372bb6826bd81d3542a419d6-2"`}, "Server": {"AmazonS3"}}, ""},
+	} {
+		if got := digests(tt.header)["md5"]; got != tt.want {
+			t.Errorf("%s: expected md5 %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestKeepFilename(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("video")))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"keep_filename": "true"})
+	Register(context.Background(), "keepname", srv.URL+"/media/My%20Video.mp4?sig=1", nil)
+
+	remote := f.VirtualPath("keepname")
+	if remote != "ke/keepname/My Video.mp4" {
+		t.Fatalf("unexpected virtual path %q", remote)
+	}
+	if got := f.HashOf(remote); got != "keepname" {
+		t.Errorf("expected HashOf to return keepname, got %q", got)
+	}
+
+	entries, err := f.List(ctx, "ke/keepname")
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Remote() != remote {
+		t.Fatalf("expected listing to contain %q, got %v", remote, entries)
+	}
+	if _, err := f.NewObject(ctx, "ke/keepname/other.mp4"); err == nil {
+		t.Error("expected a different file name not to resolve")
+	}
+}
+
+func TestHashOfFilenameOfOtherHash(t *testing.T) {
+	serve := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		}))
+	}
+	victim, attacker := serve("victim"), serve("attacker")
+	defer victim.Close()
+	defer attacker.Close()
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"keep_filename": "true"})
+	Register(ctx, "victimhash", victim.URL+"/private", http.Header{"Cookie": {"session=victim"}})
+	Register(ctx, "attackerhash", attacker.URL+"/victimhash", nil)
+
+	remote := f.VirtualPath("attackerhash")
+	if remote != "at/attackerhash/victimhash" {
+		t.Fatalf("unexpected virtual path %q", remote)
+	}
+	if got := f.HashOf(remote); got != "attackerhash" {
+		t.Fatalf("expected the path to resolve to its own link, got %q", got)
+	}
+	obj, err := f.NewObject(ctx, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := obj.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	if body, _ := io.ReadAll(in); string(body) != "attacker" {
+		t.Errorf("expected the attacker's own content, got %q", body)
+	}
+	for _, remote := range []string{"vi/victimhash", "at/victimhash", "xx/attackerhash/private"} {
+		if got := f.HashOf(remote); got != "" {
+			t.Errorf("%s: expected no link, got %q", remote, got)
+		}
+	}
+}
+
+func TestTenantNamespace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("tenant")))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	newTenantFs := func(root string) *Fs {
+		f, err := NewFs(ctx, "link-test", root, configmap.Simple{})
+		if err != nil {
+			t.Fatalf("failed to create fs: %v", err)
+		}
+		return f.(*Fs)
+	}
+	teamA, teamB, whole := newTenantFs("team-a"), newTenantFs("team-b"), newTenantFs("")
+	teamA.Register(ctx, "tenantfile", srv.URL, nil)
+
+	if got := teamA.VirtualPath("tenantfile"); got != "te/tenantfile" {
+		t.Errorf("expected path relative to the tenant root, got %q", got)
+	}
+	if got := whole.VirtualPath("tenantfile"); got != "team-a/te/tenantfile" {
+		t.Errorf("expected path below the tenant directory, got %q", got)
+	}
+
+	entries, err := teamA.List(ctx, "te")
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Remote() != "te/tenantfile" {
+		t.Errorf("expected tenant listing to contain the link, got %v", entries)
+	}
+	if entries, _ := teamB.List(ctx, "te"); len(entries) != 0 {
+		t.Errorf("expected other tenant not to list the link, got %v", entries)
+	}
+	if _, err := teamB.NewObject(ctx, "te/tenantfile"); !errors.Is(err, fs.ErrorObjectNotFound) {
+		t.Errorf("expected other tenant not to find the link, got %v", err)
+	}
+
+	var found bool
+	root, _ := whole.List(ctx, "")
+	for _, entry := range root {
+		if entry.Remote() == "team-a" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected tenant directory in the root listing, got %v", root)
+	}
+}
+
+func TestFilenameFromURL(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/a/b/video.mp4?x=1": "video.mp4",
+		"https://example.com/a/%2e%2e":          "",
+		"https://example.com/dir/":              "",
+		"https://example.com":                   "",
+	}
+	for u, want := range tests {
+		if got := FilenameFromURL(u); got != want {
+			t.Errorf("%s: expected %q, got %q", u, want, got)
+		}
+	}
+}
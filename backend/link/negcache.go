@@ -0,0 +1,62 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// negativeCache remembers failed metadata fetches so that repeated
+// requests for a broken link are answered without contacting the
+// upstream again until the entry expires.
+type negativeCache struct {
+	notFound  time.Duration // TTL for 404 and 410
+	forbidden time.Duration // TTL for 401 and 403
+	failure   time.Duration // TTL for rate limits, timeouts and other errors
+	entries   sync.Map      // remote -> *negativeEntry
+}
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+func (c *negativeCache) ttl(err error) time.Duration {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return 0
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrGone):
+		return c.notFound
+	case errors.Is(err, ErrForbidden):
+		return c.forbidden
+	}
+	return c.failure
+}
+
+// get returns the cached failure for remote, if any.
+func (c *negativeCache) get(remote string) error {
+	val, ok := c.entries.Load(remote)
+	if !ok {
+		return nil
+	}
+	ne := val.(*negativeEntry)
+	if time.Now().After(ne.expires) {
+		c.entries.CompareAndDelete(remote, ne)
+		return nil
+	}
+	return ne.err
+}
+
+// put records err for remote, or forgets remote if err is nil.
+func (c *negativeCache) put(remote string, err error) {
+	if err == nil {
+		c.entries.Delete(remote)
+		return
+	}
+	ttl := c.ttl(err)
+	if ttl <= 0 {
+		return
+	}
+	c.entries.Store(remote, &negativeEntry{err: err, expires: time.Now().Add(ttl)})
+}
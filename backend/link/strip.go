@@ -1,31 +1,100 @@
 package link
 
 import (
+	"fmt"
+	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"slices"
+	"strings"
 )
 
 func StripURL(u string, stripQuery, stripDomain bool) string {
-	if !stripQuery && !stripDomain {
-		return u
-	}
+	p := KeyPolicy{StripQuery: stripQuery, StripDomain: stripDomain}
+	return p.Key(u, nil)
+}
+
+// KeyPolicy describes how a URL is reduced to the key identifying its
+// cache entry, so that URLs which differ only in irrelevant parts share
+// one cached file.
+type KeyPolicy struct {
+	StripQuery  bool      // drop the whole query string
+	StripDomain bool      // drop scheme, host, user info and fragment
+	KeepQuery   []string  // if set, only keep these query parameters
+	DropQuery   []string  // query parameters to drop, e.g. auth tokens
+	Rewrites    []Rewrite // applied in order to the URL before anything else
+	Headers     []string  // request headers appended to the key
+}
 
-	parsedURL, err := url.Parse(u)
+// Rewrite replaces matches of Pattern in a URL with Replacement, which
+// may reference capture groups as in regexp.Regexp.ReplaceAllString.
+type Rewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRewrite parses a rewrite rule written as "pattern=>replacement".
+func ParseRewrite(rule string) (Rewrite, error) {
+	pattern, replacement, ok := strings.Cut(rule, "=>")
+	if !ok {
+		return Rewrite{}, fmt.Errorf("invalid rewrite rule %q: expected pattern=>replacement", rule)
+	}
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		return u
+		return Rewrite{}, fmt.Errorf("invalid rewrite pattern %q: %w", pattern, err)
 	}
+	return Rewrite{Pattern: re, Replacement: replacement}, nil
+}
 
-	if stripQuery {
-		parsedURL.RawQuery = ""
+// Key returns the cache key for u. Header values listed in p.Headers are
+// taken from header, which may be nil.
+func (p *KeyPolicy) Key(u string, header http.Header) string {
+	for _, rw := range p.Rewrites {
+		u = rw.Pattern.ReplaceAllString(u, rw.Replacement)
 	}
-	if stripDomain {
-		parsedURL.Scheme = ""
-		parsedURL.Host = ""
-		parsedURL.User = nil
-		parsedURL.Fragment = ""
+
+	filterQuery := len(p.KeepQuery) > 0 || len(p.DropQuery) > 0
+	if p.StripQuery || p.StripDomain || filterQuery {
+		if parsedURL, err := url.Parse(u); err == nil {
+			if p.StripQuery {
+				parsedURL.RawQuery = ""
+			} else if filterQuery {
+				parsedURL.RawQuery = p.filterQuery(parsedURL.Query()).Encode()
+			}
+			if p.StripDomain {
+				parsedURL.Scheme = ""
+				parsedURL.Host = ""
+				parsedURL.User = nil
+				parsedURL.Fragment = ""
+			}
+			u = parsedURL.String()
+		}
 	}
 
-	return parsedURL.String()
+	if len(p.Headers) == 0 {
+		return u
+	}
+	var b strings.Builder
+	b.WriteString(u)
+	for _, name := range p.Headers {
+		b.WriteString("\n")
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteString(":")
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (p *KeyPolicy) filterQuery(q url.Values) url.Values {
+	for name := range q {
+		if len(p.KeepQuery) > 0 && !slices.Contains(p.KeepQuery, name) {
+			q.Del(name)
+		} else if slices.Contains(p.DropQuery, name) {
+			q.Del(name)
+		}
+	}
+	return q
 }
 
 func ShardedPath(fileHash string, level int) string {
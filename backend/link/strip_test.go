@@ -0,0 +1,68 @@
+package link
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStripURL(t *testing.T) {
+	u := "https://user@cdn.example.com/path/video.mp4?token=abc#frag"
+
+	if got := StripURL(u, false, false); got != u {
+		t.Errorf("expected URL unchanged, got %q", got)
+	}
+	if got := StripURL(u, true, false); got != "https://user@cdn.example.com/path/video.mp4#frag" {
+		t.Errorf("unexpected strip query result %q", got)
+	}
+	if got := StripURL(u, true, true); got != "/path/video.mp4" {
+		t.Errorf("unexpected strip query and domain result %q", got)
+	}
+}
+
+func TestKeyPolicyQuery(t *testing.T) {
+	keep := KeyPolicy{KeepQuery: []string{"quality"}}
+	a := keep.Key("https://example.com/v.mp4?quality=hd&sig=1&expires=2", nil)
+	b := keep.Key("https://example.com/v.mp4?sig=9&quality=hd", nil)
+	if a != b || a != "https://example.com/v.mp4?quality=hd" {
+		t.Errorf("expected keys to keep only quality, got %q and %q", a, b)
+	}
+	if c := keep.Key("https://example.com/v.mp4?quality=sd", nil); c == a {
+		t.Error("expected different quality to produce a different key")
+	}
+
+	drop := KeyPolicy{DropQuery: []string{"sig", "expires"}}
+	if got := drop.Key("https://example.com/v.mp4?sig=1&quality=hd&expires=2", nil); got != "https://example.com/v.mp4?quality=hd" {
+		t.Errorf("unexpected drop query result %q", got)
+	}
+}
+
+func TestKeyPolicyRewrite(t *testing.T) {
+	rw, err := ParseRewrite(`^https://cdn\d+\.example\.com/=>https://cdn.example.com/`)
+	if err != nil {
+		t.Fatalf("failed to parse rewrite: %v", err)
+	}
+	p := KeyPolicy{Rewrites: []Rewrite{rw}}
+	if got := p.Key("https://cdn42.example.com/a.bin", nil); got != "https://cdn.example.com/a.bin" {
+		t.Errorf("unexpected rewrite result %q", got)
+	}
+
+	if _, err := ParseRewrite("no-separator"); err == nil {
+		t.Error("expected error for rule without separator")
+	}
+	if _, err := ParseRewrite("([=>x"); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestKeyPolicyHeaders(t *testing.T) {
+	p := KeyPolicy{Headers: []string{"accept-language"}}
+	en := http.Header{"Accept-Language": {"en"}}
+	de := http.Header{"Accept-Language": {"de"}}
+
+	if p.Key("https://example.com/a", en) == p.Key("https://example.com/a", de) {
+		t.Error("expected header values to change the key")
+	}
+	if p.Key("https://example.com/a", en) != p.Key("https://example.com/a", en.Clone()) {
+		t.Error("expected equal headers to produce equal keys")
+	}
+}
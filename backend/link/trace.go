@@ -0,0 +1,107 @@
+package link
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/tgdrive/rclone-vfs/backend/link")
+
+// traceContext returns ctx, or if it carries no span a context whose
+// parent is the span of the request which last registered e. The VFS
+// does not pass request contexts down, so without this upstream fetches
+// would start traces of their own.
+func (e *entry) traceContext(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	e.mu.Lock()
+	sc := e.span
+	e.mu.Unlock()
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, sc)
+}
+
+// do sends req with the pacer inside a client span recording the range,
+// retries and response status. The span ends when the response body is
+// closed, or on return if there is no body to read.
+func (f *Fs) do(ctx context.Context, client *http.Client, req *http.Request, remote string) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("link.hash", remote),
+		))
+	if rng := req.Header.Get("Range"); rng != "" {
+		span.SetAttributes(attribute.String("http.request.header.range", rng))
+	}
+
+	// Replace any trace headers registered with the link by our own
+	propagator := otel.GetTextMapPropagator()
+	for _, key := range propagator.Fields() {
+		req.Header.Del(key)
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	var (
+		resp    *http.Response
+		attempt int
+	)
+	err := f.pacer.Call(func() (bool, error) {
+		if attempt > 0 {
+			span.AddEvent("retry", trace.WithAttributes(attribute.Int("http.request.resend_count", attempt)))
+		}
+		attempt++
+		var err error
+		resp, err = client.Do(req)
+		return shouldRetry(ctx, resp, err)
+	})
+	span.SetAttributes(attribute.Int("http.request.resend_count", attempt-1))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	if req.Method == "HEAD" || resp.Body == nil {
+		span.End()
+		return resp, nil
+	}
+	resp.Body = &spanReader{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// spanReader ends span once the body it wraps is closed, recording how
+// many bytes were read.
+type spanReader struct {
+	io.ReadCloser
+	span trace.Span
+	n    int64
+}
+
+func (r *spanReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *spanReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.span.SetAttributes(attribute.Int64("link.bytes_read", r.n))
+	r.span.End()
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"runtime/debug"
 	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -71,6 +72,7 @@ func (v *VFS) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("failed to create VFS handler: %w", err)
 	}
 
+	handler.ManifestURL = v.manifestURL
 	v.handler = handler
 	v.logger.Info("VFS handler provisioned",
 		zap.String("upstream", v.Upstream),
@@ -80,6 +82,17 @@ func (v *VFS) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// manifestURL maps URLs under the upstream in rewritten manifests to
+// the paths they are served at. Other URLs are left pointing at their
+// origin, as they can't be fetched through this handler.
+func (v *VFS) manifestURL(r *http.Request, targetURL string, template bool) string {
+	base := strings.TrimSuffix(v.upstreamURL.String(), "/")
+	if rest, ok := strings.CutPrefix(targetURL, base); ok && strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return targetURL
+}
+
 // Validate ensures the configuration is valid.
 func (v *VFS) Validate() error {
 	if v.Upstream == "" {
@@ -119,7 +132,8 @@ func (v *VFS) Cleanup() error {
 	return nil
 }
 
-// ServeHTTP serves the HTTP request.
+// ServeHTTP serves the HTTP request. The request path always names a
+// file of the upstream, so archive members aren't served here.
 func (v *VFS) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	// Build full URL using url.JoinPath for proper path handling
 	fullURL := v.upstreamURL.JoinPath(r.URL.Path).String()
@@ -169,6 +183,9 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 
 // UnmarshalCaddyfile sets up the handler from Caddyfile tokens.
 func (v *VFS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// Lists given in the Caddyfile replace their defaults, and add up
+	// over repetitions of the directive
+	listed := make(map[string]bool)
 	for d.Next() {
 		if d.NextArg() {
 			v.Upstream = d.Val()
@@ -211,6 +228,16 @@ func (v *VFS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 							return d.Errf("invalid value for %s: %v", directive, err)
 						}
 						f.SetInt(int64(i))
+					case reflect.Slice:
+						args := d.RemainingArgs()
+						if len(args) == 0 {
+							return d.ArgErr()
+						}
+						if !listed[directive] {
+							f.Set(reflect.Zero(f.Type()))
+							listed[directive] = true
+						}
+						f.Set(reflect.AppendSlice(f, reflect.ValueOf(args)))
 					}
 					found = true
 					break
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"slices"
 	"testing"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -17,6 +18,10 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			strip_query
 			shard-level 3
 			read_only
+			key_keep_query quality lang
+			key_keep_query format
+			cors_allow_headers Range
+			cors_allow_headers X-Custom
 		}
 	`)
 
@@ -60,6 +65,19 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 		t.Error("expected ReadOnly to be true")
 	}
 
+	// Test reflection-mapped list options
+	if want := []string{"quality", "lang", "format"}; !slices.Equal(v.KeyKeepQuery, want) {
+		t.Errorf("expected KeyKeepQuery %v, got %v", want, v.KeyKeepQuery)
+	}
+
+	// Lists replace their defaults
+	if want := []string{"Range", "X-Custom"}; !slices.Equal(v.CORSAllowHeaders, want) {
+		t.Errorf("expected CORSAllowHeaders %v, got %v", want, v.CORSAllowHeaders)
+	}
+	if want := vfsproxy.DefaultOptions().CORSExposeHeaders; !slices.Equal(v.CORSExposeHeaders, want) {
+		t.Errorf("expected default CORSExposeHeaders %v, got %v", want, v.CORSExposeHeaders)
+	}
+
 	// Test defaults for things not in the Caddyfile
 	if v.FsName != "rclone-vfs" {
 		t.Errorf("expected default FsName 'rclone-vfs', got '%s'", v.FsName)
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/lib/sdactivation"
+)
+
+// unixSocketPath returns the socket path of a unix:/path listen address.
+func unixSocketPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return path, true
+	}
+	return strings.CutPrefix(addr, "unix:")
+}
+
+// listen opens a listener for each of addrs. If the service manager
+// passed sockets with systemd socket activation, those are used instead.
+func listen(addrs []string) ([]net.Listener, error) {
+	sdListeners, err := sdactivation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("unable to acquire systemd listeners: %w", err)
+	}
+	if len(sdListeners) > 0 {
+		return sdListeners, nil
+	}
+
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		var (
+			ln  net.Listener
+			err error
+		)
+		if path, ok := unixSocketPath(addr); ok {
+			ln, err = listenUnix(path)
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, ln := range listeners {
+				_ = ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on the unix socket path, replacing a stale socket
+// left behind by a previous run, and applies --socket-mode and
+// --socket-group.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPerms(path); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func setSocketPerms(path string) error {
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid --socket-mode %q: %w", *socketMode, err)
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		return err
+	}
+	if *socketGroup == "" {
+		return nil
+	}
+	gid, err := strconv.Atoi(*socketGroup)
+	if err != nil {
+		group, err := user.LookupGroup(*socketGroup)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, -1, gid)
+}
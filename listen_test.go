@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketPath(t *testing.T) {
+	for addr, want := range map[string]string{
+		"unix:/run/vfs.sock":   "/run/vfs.sock",
+		"unix:///run/vfs.sock": "/run/vfs.sock",
+		"unix:vfs.sock":        "vfs.sock",
+		":8080":                "",
+	} {
+		got, ok := unixSocketPath(addr)
+		if ok != (want != "") || ok && got != want {
+			t.Errorf("unixSocketPath(%q) = %q, %v", addr, got, ok)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vfs.sock")
+
+	// A socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("failed to replace stale socket: %v", err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0660 {
+		t.Errorf("expected mode 0660, got %o", perm)
+	}
+
+	// A socket in use is not
+	if _, err := listenUnix(path); err == nil {
+		t.Error("expected an error listening on a socket in use")
+	}
+}
@@ -3,7 +3,12 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,74 +16,225 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/tgdrive/rclone-vfs/pkg/evict"
 	"github.com/tgdrive/rclone-vfs/pkg/vfsproxy"
 
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/config"
+	fslog "github.com/rclone/rclone/fs/log"
+	"github.com/rclone/rclone/fs/log/logflags"
 	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
 )
 
 var (
-	port = pflag.String("port", "8080", "Port to listen on")
-	opt  = vfsproxy.DefaultOptions()
+	port          = pflag.String("port", "8080", "Port to listen on")
+	addrs         = pflag.StringArray("addr", nil, "Address to listen on, e.g. 127.0.0.1:8080 or unix:/run/rclone-vfs.sock, overrides --port (repeatable)")
+	socketMode    = pflag.String("socket-mode", "0660", "Permissions of unix sockets")
+	socketGroup   = pflag.String("socket-group", "", "Group owning unix sockets")
+	tlsCert       = pflag.String("tls-cert", "", "TLS certificate file, reloaded when it changes")
+	tlsKey        = pflag.String("tls-key", "", "TLS private key file, reloaded when it changes")
+	tlsSelfSigned = pflag.Bool("tls-self-signed", false, "Serve TLS with a generated self-signed certificate, for testing")
+	enableHTTP3   = pflag.Bool("http3", false, "Also serve HTTP/3 over QUIC on the same port, requires TLS")
+	readTimeout   = pflag.Duration("read-timeout", 0, "Maximum duration for reading a request, 0 for none")
+	writeTimeout  = pflag.Duration("write-timeout", 0, "Maximum duration for writing a response, 0 for none")
+	idleTimeout   = pflag.Duration("idle-timeout", 2*time.Minute, "How long to keep idle keep-alive connections open")
+	admin         = pflag.Bool("admin", false, "Serve the admin API under /admin/")
+	shutdownDelay = pflag.Duration("shutdown-delay", 0, "How long to keep serving with /readyz failing before shutting down")
+	accessLog     = pflag.String("access-log", "", "Write JSON access logs to this file, or to stdout or stderr")
+	accessSample  = pflag.Float64("access-log-sample", 1, "Fraction of requests to write to the access log")
+	otlpEndpoint  = pflag.String("otlp-endpoint", "", "Export traces with OTLP over HTTP to this URL, e.g. http://localhost:4318")
+	verbose       = pflag.CountP("verbose", "v", "Print lots more stuff (repeat for more)")
+	quiet         = pflag.BoolP("quiet", "q", false, "Print as little stuff as possible")
+	logLevel      = fs.LogLevelNotice
+	opt           = vfsproxy.DefaultOptions()
+
+	// version is set at build time
+	version = "dev"
 )
 
 func main() {
 	opt.AddFlags(pflag.CommandLine)
+	pflag.Var(&logLevel, "log-level", "Log level DEBUG|INFO|NOTICE|ERROR")
+	logflags.AddFlags(pflag.CommandLine)
 	pflag.Parse()
 
+	level := setupLogging()
+
+	shutdownTracing, err := setupTracing(*otlpEndpoint)
+	if err != nil {
+		log.Fatalf("tracing: %v", err)
+	}
+
+	// "rclone-vfs simulate <access-log>" replays an access log against
+	// every cache policy and exits
+	if pflag.Arg(0) == "simulate" {
+		if err := simulate(pflag.Arg(1), opt.CacheMaxSize); err != nil {
+			log.Fatalf("simulate: %v", err)
+		}
+		return
+	}
+
 	handler, err := vfsproxy.NewHandler(opt)
 	if err != nil {
 		log.Fatal(err)
 	}
+	handler.Version = version
 
 	mux := http.NewServeMux()
 
 	mainHandler := func(w http.ResponseWriter, r *http.Request) {
 		targetURL := r.URL.Query().Get("url")
 
-		// Check for Base64 URL in path
-		if targetURL == "" && strings.HasPrefix(r.URL.Path, "/stream/") {
-			encodedURL := strings.TrimPrefix(r.URL.Path, "/stream/")
-			if decoded, err := base64.RawURLEncoding.DecodeString(encodedURL); err == nil {
-				targetURL = string(decoded)
-			} else if decoded, err := base64.URLEncoding.DecodeString(encodedURL); err == nil {
-				targetURL = string(decoded)
+		// Check for Base64 URL in path, which may be followed by the
+		// path of an archive member, as /stream/<base64>/zip/<member>
+		var archivePath string
+		if _, rest, ok := strings.Cut(r.URL.Path, "/stream/"); ok {
+			if targetURL != "" {
+				archivePath = rest
+			} else {
+				var encodedURL string
+				encodedURL, archivePath, _ = strings.Cut(rest, "/")
+				if decoded, err := base64.RawURLEncoding.DecodeString(encodedURL); err == nil {
+					targetURL = string(decoded)
+				} else if decoded, err := base64.URLEncoding.DecodeString(encodedURL); err == nil {
+					targetURL = string(decoded)
+				}
 			}
 		}
 
 		if targetURL == "" {
-			http.Error(w, "Missing 'url' parameter or base64 path", http.StatusBadRequest)
+			if handler.ServeCORS(w, r) {
+				return
+			}
+			vfsproxy.WriteError(w, r, http.StatusBadRequest, "Missing 'url' parameter or base64 path")
 			return
 		}
 
+		if archivePath != "" {
+			format, member, _ := strings.Cut(archivePath, "/")
+			handler.ServeArchive(w, r, targetURL, format, member)
+			return
+		}
 		handler.Serve(w, r, targetURL)
 	}
 
-	mux.HandleFunc("/stream", mainHandler)
-	mux.HandleFunc("/stream/", mainHandler)
+	var stream http.Handler = http.HandlerFunc(mainHandler)
+	if *accessLog != "" {
+		w, err := openAccessLog(*accessLog)
+		if err != nil {
+			log.Fatalf("access log: %v", err)
+		}
+		if *accessSample <= 0 || *accessSample > 1 {
+			log.Fatalf("--access-log-sample must be greater than 0 and at most 1")
+		}
+		stream = vfsproxy.NewAccessLogger(w, level, *accessSample).Wrap(stream)
+	}
+
+	if opt.TenantFrom == "path" {
+		// The tenant is the first path segment, as /team-a/stream
+		mux.Handle("/{tenant}/stream", stream)
+		mux.Handle("/{tenant}/stream/", stream)
+	} else {
+		mux.Handle("/stream", stream)
+		mux.Handle("/stream/", stream)
+	}
+	mux.HandleFunc("/healthz", handler.ServeHealthz)
+	mux.HandleFunc("/readyz", handler.ServeReadyz)
+	mux.HandleFunc("/status", handler.ServeStatus)
+
+	if *admin {
+		mux.Handle("/admin/", http.StripPrefix("/admin", handler.AdminHandler()))
+	}
+
+	listenAddrs := *addrs
+	if len(listenAddrs) == 0 {
+		listenAddrs = []string{":" + *port}
+	}
+	var host string
+	for _, addr := range listenAddrs {
+		if _, ok := unixSocketPath(addr); !ok {
+			host, _, _ = net.SplitHostPort(addr)
+			break
+		}
+	}
+	tlsConfig, err := newTLSConfig(host)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	srv := &http.Server{
-		Addr:    ":" + *port,
-		Handler: mux,
+		Handler:      mux,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+
+	listeners, err := listen(listenAddrs)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+
+	// HTTP/3 is served on the UDP port matching each TCP listener
+	var (
+		h3   *http3.Server
+		udps []net.PacketConn
+	)
+	if *enableHTTP3 {
+		if tlsConfig == nil {
+			log.Fatal("--http3 needs --tls-cert and --tls-key or --tls-self-signed")
+		}
+		h3 = &http3.Server{
+			Handler:     mux,
+			TLSConfig:   http3.ConfigureTLSConfig(tlsConfig),
+			IdleTimeout: *idleTimeout,
+		}
+		for _, ln := range listeners {
+			if ln.Addr().Network() != "tcp" {
+				continue
+			}
+			udp, err := net.ListenPacket("udp", ln.Addr().String())
+			if err != nil {
+				log.Fatalf("listen: %v", err)
+			}
+			udps = append(udps, udp)
+		}
+		srv.Handler = altSvc(h3, mux)
 	}
 
 	// Channel to listen for signals
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	go func() {
-		log.Printf("VFS Proxy listening on :%s", *port)
-		log.Printf("VFS Cache Mode: %v", handler.VFS.Opt.CacheMode)
-		log.Printf("VFS Cache Dir: %s", config.GetCacheDir())
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
+	log.Printf("VFS Cache Mode: %v", handler.VFS.Opt.CacheMode)
+	log.Printf("VFS Cache Dir: %s", config.GetCacheDir())
+	for _, ln := range listeners {
+		go serve(srv, ln, tlsConfig != nil)
+	}
+	for _, udp := range udps {
+		go func() {
+			log.Printf("HTTP/3 listening on %s", udp.LocalAddr())
+			if err := h3.Serve(udp); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("http3: %v", err)
+			}
+		}()
+	}
 
 	<-stop
 
 	log.Println("Shutting down gracefully...")
 
+	// Fail readiness first so load balancers stop routing to us
+	handler.Drain()
+	time.Sleep(*shutdownDelay)
+
 	// Create a context with timeout for the shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -86,9 +242,140 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
+	if h3 != nil {
+		if err := h3.Shutdown(ctx); err != nil {
+			log.Printf("HTTP/3 server forced to shutdown: %v", err)
+		}
+		for _, udp := range udps {
+			_ = udp.Close()
+		}
+	}
 
 	log.Println("Shutting down VFS...")
 	handler.Shutdown()
 
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
+
 	log.Println("Exit")
 }
+
+// setupLogging applies the rclone log flags and returns the slog level
+// corresponding to the configured log level.
+func setupLogging() slog.Level {
+	switch {
+	case *verbose > 0 && *quiet:
+		log.Fatal("Can't set -v and -q")
+	case *verbose >= 2:
+		logLevel = fs.LogLevelDebug
+	case *verbose == 1:
+		logLevel = fs.LogLevelInfo
+	case *quiet:
+		logLevel = fs.LogLevelError
+	}
+	fslog.InitLogging()
+	ci := fs.GetConfig(context.Background())
+	ci.LogLevel = logLevel
+	if err := fs.LogReload(ci); err != nil {
+		log.Fatal(err)
+	}
+	return fs.LogLevelToSlog(logLevel)
+}
+
+// openAccessLog returns the writer for the access log destination dest.
+func openAccessLog(dest string) (io.Writer, error) {
+	switch dest {
+	case "-", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", dest, err)
+	}
+	return f, nil
+}
+
+// simulate prints the hit ratios every cache policy would have achieved
+// on the requests in the access log name with a cache of maxSize.
+func simulate(name, maxSize string) error {
+	if name == "" {
+		return errors.New("usage: rclone-vfs simulate --max-size SIZE ACCESS-LOG")
+	}
+	var size fs.SizeSuffix
+	if err := size.Set(maxSize); err != nil || size <= 0 {
+		return fmt.Errorf("need a --max-size above 0, got %q", maxSize)
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	trace, err := evict.ReadAccessLog(in)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d requests, cache of %v\n", len(trace), size)
+	for _, policy := range evict.Policies {
+		res, err := evict.Simulate(policy, int64(size), trace)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-8s hit ratio %5.1f%%  byte hit ratio %5.1f%%  rejected %d\n",
+			policy, 100*res.HitRatio(), 100*res.ByteHitRatio(), res.Rejected)
+	}
+	return nil
+}
+
+// serve serves srv on ln, with TLS on TCP listeners if useTLS is set.
+func serve(srv *http.Server, ln net.Listener, useTLS bool) {
+	var err error
+	switch {
+	case ln.Addr().Network() == "unix":
+		log.Printf("VFS Proxy listening on unix:%s", ln.Addr())
+		err = srv.Serve(ln)
+	case useTLS:
+		log.Printf("VFS Proxy listening on https://%s", ln.Addr())
+		err = srv.ServeTLS(ln, "", "")
+	default:
+		log.Printf("VFS Proxy listening on http://%s", ln.Addr())
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("listen: %s\n", err)
+	}
+}
+
+// altSvc returns a handler advertising h3 to clients of next.
+func altSvc(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setupTracing installs an OpenTelemetry tracer provider exporting to
+// endpoint and returns a function flushing it. Tracing is off if
+// endpoint is empty.
+func setupTracing(endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("rclone-vfs"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
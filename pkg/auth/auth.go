@@ -0,0 +1,180 @@
+// Package auth authenticates clients of the proxy and decides which
+// upstream hosts they may fetch from.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrNoCredentials is returned if the request carries no
+	// credentials the Authenticator understands.
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned if the credentials are
+	// understood but wrong or expired.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is an authenticated client.
+type Identity struct {
+	Name string
+
+	// Hosts the identity may fetch from. Entries starting with "*."
+	// also match subdomains. Nil allows any host.
+	Hosts []string
+}
+
+// AllowsHost returns true if the identity may fetch from host.
+func (id *Identity) AllowsHost(host string) bool {
+	if id.Hosts == nil {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range id.Hosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the client making a request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Challenger is implemented by Authenticators which want to ask for
+// credentials with a WWW-Authenticate header.
+type Challenger interface {
+	Challenge() string
+}
+
+// Chain tries each Authenticator in turn until one of them recognises
+// the credentials.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator.
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Challenge implements Challenger.
+func (c Chain) Challenge() string {
+	var challenges []string
+	for _, a := range c {
+		if ch, ok := a.(Challenger); ok {
+			if challenge := ch.Challenge(); challenge != "" && !slices.Contains(challenges, challenge) {
+				challenges = append(challenges, challenge)
+			}
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// RestrictHosts returns an Authenticator which limits the identities
+// authenticated by a to the hosts listed for their name, unless a
+// already set their hosts.
+func RestrictHosts(a Authenticator, hosts map[string][]string) Authenticator {
+	return hostRestriction{Authenticator: a, hosts: hosts}
+}
+
+type hostRestriction struct {
+	Authenticator
+	hosts map[string][]string
+}
+
+func (h hostRestriction) Authenticate(r *http.Request) (*Identity, error) {
+	id, err := h.Authenticator.Authenticate(r)
+	if err == nil && id.Hosts == nil {
+		id.Hosts = h.hosts[id.Name]
+	}
+	return id, err
+}
+
+func (h hostRestriction) Challenge() string {
+	if ch, ok := h.Authenticator.(Challenger); ok {
+		return ch.Challenge()
+	}
+	return ""
+}
+
+// bearerToken returns the bearer token sent with r.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Tokens authenticates static bearer tokens.
+type Tokens struct {
+	names  []string
+	tokens [][]byte
+}
+
+// NewTokens returns an Authenticator accepting the bearer tokens in
+// tokens, which maps identity names to tokens.
+func NewTokens(tokens map[string]string) *Tokens {
+	t := &Tokens{}
+	for name, token := range tokens {
+		t.names = append(t.names, name)
+		t.tokens = append(t.tokens, []byte(token))
+	}
+	return t
+}
+
+// Authenticate implements Authenticator. Unknown tokens are reported as
+// ErrNoCredentials so that other Authenticators can check them.
+func (t *Tokens) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	name := ""
+	for i, want := range t.tokens {
+		// Compare with every token so timing doesn't reveal which matched
+		if subtle.ConstantTimeCompare([]byte(token), want) == 1 {
+			name = t.names[i]
+		}
+	}
+	if name == "" {
+		return nil, ErrNoCredentials
+	}
+	return &Identity{Name: name}, nil
+}
+
+// Challenge implements Challenger.
+func (t *Tokens) Challenge() string {
+	return `Bearer realm="rclone-vfs"`
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the Identity stored in ctx, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestAllowsHost(t *testing.T) {
+	id := &Identity{Hosts: []string{"cdn.example.com", "*.media.example"}}
+	for host, want := range map[string]bool{
+		"cdn.example.com":      true,
+		"CDN.example.com":      true,
+		"a.media.example":      true,
+		"media.example":        false,
+		"evil.example.com":     false,
+		"cdn.example.com.evil": false,
+	} {
+		if got := id.AllowsHost(host); got != want {
+			t.Errorf("AllowsHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if !(&Identity{}).AllowsHost("anything") {
+		t.Error("expected nil Hosts to allow any host")
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	sum := sha1.Sum([]byte("secret"))
+	if err := os.WriteFile(htpasswd, []byte("alice:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHtpasswd(htpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := RestrictHosts(Chain{NewTokens(map[string]string{"bot": "s3cr3t"}), h}, map[string][]string{"bot": {"cdn.example.com"}})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	id, err := a.Authenticate(r)
+	if err != nil || id.Name != "bot" || len(id.Hosts) != 1 {
+		t.Errorf("expected bot restricted to one host, got %+v, %v", id, err)
+	}
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := a.Authenticate(r); err == nil {
+		t.Error("expected unknown token to be rejected")
+	}
+
+	r.SetBasicAuth("alice", "secret")
+	if id, err := a.Authenticate(r); err != nil || id.Name != "alice" || id.Hosts != nil {
+		t.Errorf("expected alice with any host, got %+v, %v", id, err)
+	}
+	r.SetBasicAuth("alice", "wrong")
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+
+	if got := a.(Challenger).Challenge(); got != `Bearer realm="rclone-vfs", Basic realm="rclone-vfs"` {
+		t.Errorf("unexpected challenge %q", got)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jose.JSONWebKey{Key: key, KeyID: "k1", Algorithm: string(jose.ES256)}
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk.Public()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := NewJWT(path, "https://issuer.example", "rclone-vfs", "allowed_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims jwt.Claims, extra map[string]any) string {
+		tok, err := jwt.Signed(signer).Claims(claims).Claims(extra).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := jwt.Claims{
+		Subject:  "player",
+		Issuer:   "https://issuer.example",
+		Audience: jwt.Audience{"rclone-vfs"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+sign(valid, map[string]any{"allowed_hosts": []string{"cdn.example.com"}}))
+	id, err := j.Authenticate(r)
+	if err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+	if id.Name != "player" || !id.AllowsHost("cdn.example.com") || id.AllowsHost("other.example.com") {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	r.Header.Set("Authorization", "Bearer "+sign(expired, nil))
+	if _, err := j.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected expired token to be rejected, got %v", err)
+	}
+
+	wrongAudience := valid
+	wrongAudience.Audience = jwt.Audience{"someone-else"}
+	r.Header.Set("Authorization", "Bearer "+sign(wrongAudience, nil))
+	if _, err := j.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected token for other audience to be rejected, got %v", err)
+	}
+}
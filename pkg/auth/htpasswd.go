@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	httpauth "github.com/abbot/go-http-auth"
+	"github.com/rclone/rclone/fs"
+)
+
+// Htpasswd authenticates HTTP basic credentials against an htpasswd
+// file. bcrypt, SHA1 and Apache MD5 entries are supported. The file is
+// read again when it changes.
+type Htpasswd struct {
+	path  string
+	basic *httpauth.BasicAuth
+
+	mu      sync.Mutex
+	users   map[string]string
+	modTime time.Time
+}
+
+// NewHtpasswd returns an Authenticator checking users in the htpasswd
+// file at path.
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	h.basic = httpauth.NewBasicAuthenticator("rclone-vfs", h.secret)
+	return h, nil
+}
+
+// load reads the file if it changed. Call with mu held.
+func (h *Htpasswd) load() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+	in, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	r := csv.NewReader(in)
+	r.Comma = ':'
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = 2
+	records, err := r.ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", h.path, err)
+	}
+	users := make(map[string]string, len(records))
+	for _, record := range records {
+		users[record[0]] = record[1]
+	}
+	h.users = users
+	h.modTime = fi.ModTime()
+	return nil
+}
+
+// secret implements httpauth.SecretProvider.
+func (h *Htpasswd) secret(user, realm string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		fs.Errorf(nil, "Failed to reload htpasswd file, using the previous one: %v", err)
+	}
+	return h.users[user]
+}
+
+// Authenticate implements Authenticator.
+func (h *Htpasswd) Authenticate(r *http.Request) (*Identity, error) {
+	if _, _, ok := r.BasicAuth(); !ok {
+		return nil, ErrNoCredentials
+	}
+	user := h.basic.CheckAuth(r)
+	if user == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Name: user}, nil
+}
+
+// Challenge implements Challenger.
+func (h *Htpasswd) Challenge() string {
+	return `Basic realm="rclone-vfs"`
+}
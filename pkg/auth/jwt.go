@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// signatureAlgorithms are the JWT signatures accepted. Symmetric
+// algorithms are left out as the keys come from a JWKS file.
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// JWT authenticates bearer JSON Web Tokens signed by one of the keys in
+// a JWKS file. The subject claim names the identity.
+type JWT struct {
+	keys       jose.JSONWebKeySet
+	issuer     string
+	audience   string
+	hostsClaim string
+}
+
+// NewJWT returns an Authenticator for tokens signed by the keys in the
+// JWKS file at path. If issuer or audience are set the tokens must
+// carry them. hostsClaim names the claim listing the hosts the token
+// grants access to, as an array or a space separated string.
+func NewJWT(path, issuer, audience, hostsClaim string) (*JWT, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &JWT{issuer: issuer, audience: audience, hostsClaim: hostsClaim}
+	if err := json.Unmarshal(data, &j.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS %s: %w", path, err)
+	}
+	if len(j.keys.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in JWKS %s", path)
+	}
+	return j, nil
+}
+
+// Authenticate implements Authenticator.
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	raw, ok := bearerToken(r)
+	if !ok || strings.Count(raw, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	tok, err := jwt.ParseSigned(raw, signatureAlgorithms)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	keys := j.keys.Keys
+	if kid := tok.Headers[0].KeyID; kid != "" {
+		keys = j.keys.Key(kid)
+	}
+
+	var (
+		claims jwt.Claims
+		extra  map[string]any
+	)
+	verified := false
+	for _, key := range keys {
+		if tok.Claims(key.Public(), &claims, &extra) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidCredentials
+	}
+	expected := jwt.Expected{Issuer: j.issuer, Time: time.Now()}
+	if j.audience != "" {
+		expected.AnyAudience = jwt.Audience{j.audience}
+	}
+	if err := claims.Validate(expected); err != nil || claims.Subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	id := &Identity{Name: claims.Subject}
+	if j.hostsClaim != "" {
+		switch hosts := extra[j.hostsClaim].(type) {
+		case string:
+			id.Hosts = strings.Fields(hosts)
+		case []any:
+			id.Hosts = []string{}
+			for _, host := range hosts {
+				if s, ok := host.(string); ok {
+					id.Hosts = append(id.Hosts, s)
+				}
+			}
+		}
+	}
+	return id, nil
+}
+
+// Challenge implements Challenger.
+func (j *JWT) Challenge() string {
+	return `Bearer realm="rclone-vfs"`
+}
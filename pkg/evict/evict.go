@@ -0,0 +1,289 @@
+// Package evict implements eviction policies and admission filters for
+// a size limited cache of files.
+package evict
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// Names of the policies understood by New.
+const (
+	LRU     = "lru"     // evict the least recently used file
+	LFU     = "lfu"     // evict the least frequently used file
+	GDSF    = "gdsf"    // evict by frequency per byte, favouring small files
+	TinyLFU = "tinylfu" // LRU behind a TinyLFU admission filter
+)
+
+// Policies lists the names of all policies.
+var Policies = []string{LRU, LFU, GDSF, TinyLFU}
+
+// Policy orders the files of a cache for eviction.
+type Policy interface {
+	// Touch records an access to key, adding it if needed. size is
+	// the number of bytes it takes in the cache.
+	Touch(key string, size int64)
+
+	// Remove forgets key. evicted is true if the policy chose it.
+	Remove(key string, evicted bool)
+
+	// Victim returns the key to evict next without removing it,
+	// passing over keys for which skip returns true. skip may be nil.
+	Victim(skip func(key string) bool) (string, bool)
+}
+
+// Cache tracks the files of a cache limited to MaxSize bytes and
+// decides which to admit and which to evict. It is not safe for
+// concurrent use.
+type Cache struct {
+	MaxSize int64
+
+	policy Policy
+	filter *Sketch // nil admits every file
+	sizes  map[string]int64
+	used   int64
+}
+
+// New returns a Cache using the named policy.
+func New(policy string, maxSize int64) (*Cache, error) {
+	c := &Cache{MaxSize: maxSize, sizes: make(map[string]int64)}
+	switch policy {
+	case LRU:
+		c.policy = newLRU()
+	case LFU:
+		c.policy = newHeapPolicy(false)
+	case GDSF:
+		c.policy = newHeapPolicy(true)
+	case TinyLFU:
+		c.policy = newLRU()
+		c.filter = NewSketch(1 << 16)
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q, want one of %v", policy, Policies)
+	}
+	return c, nil
+}
+
+// Request records a request for key, a file of size bytes, and reports
+// whether it is or should be cached. Files rejected by the admission
+// filter should be served without the cache.
+func (c *Cache) Request(key string, size int64) bool {
+	if c.filter != nil {
+		c.filter.Increment(key)
+	}
+	if _, ok := c.sizes[key]; ok {
+		c.policy.Touch(key, c.sizes[key])
+		return true
+	}
+	if c.filter != nil {
+		// One-hit wonders never enter the cache, and once it is full
+		// a file has to be more popular than the one it would evict.
+		freq := c.filter.Estimate(key)
+		if freq < 2 {
+			return false
+		}
+		if c.used+size > c.MaxSize {
+			if victim, ok := c.policy.Victim(nil); ok && c.filter.Estimate(victim) >= freq {
+				return false
+			}
+		}
+	}
+	c.Add(key, size)
+	return true
+}
+
+// Add adds key bypassing the admission filter, or updates its size.
+func (c *Cache) Add(key string, size int64) {
+	c.used += size - c.sizes[key]
+	c.sizes[key] = size
+	c.policy.Touch(key, size)
+}
+
+// Contains reports whether key is cached.
+func (c *Cache) Contains(key string) bool {
+	_, ok := c.sizes[key]
+	return ok
+}
+
+// Remove forgets key, for files removed from the cache by other means.
+func (c *Cache) Remove(key string) {
+	if size, ok := c.sizes[key]; ok {
+		c.used -= size
+		delete(c.sizes, key)
+		c.policy.Remove(key, false)
+	}
+}
+
+// Evict removes files until the cache fits in MaxSize and returns
+// their keys. Keys for which skip returns true, for example because
+// they are in use, are kept.
+func (c *Cache) Evict(skip func(key string) bool) []string {
+	var victims []string
+	for c.used > c.MaxSize {
+		key, ok := c.policy.Victim(skip)
+		if !ok {
+			break
+		}
+		c.used -= c.sizes[key]
+		delete(c.sizes, key)
+		c.policy.Remove(key, true)
+		victims = append(victims, key)
+	}
+	return victims
+}
+
+// Used returns the bytes taken by the cached files.
+func (c *Cache) Used() int64 {
+	return c.used
+}
+
+// Keys returns the keys of the cached files.
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, len(c.sizes))
+	for key := range c.sizes {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// lru orders keys by the time of their last access.
+type lru struct {
+	order *list.List // front is the most recently used
+	elems map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lru) Touch(key string, size int64) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lru) Remove(key string, evicted bool) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lru) Victim(skip func(string) bool) (string, bool) {
+	for e := p.order.Back(); e != nil; e = e.Prev() {
+		key := e.Value.(string)
+		if skip == nil || !skip(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// heapPolicy evicts the key with the lowest priority, the least
+// recently used first among equals. The priority is the number of
+// accesses, or with sizeAware the GDSF priority L + accesses/size where
+// L is the priority of the last evicted key, which ages keys which are
+// no longer accessed.
+type heapPolicy struct {
+	sizeAware bool
+	entries   map[string]*heapEntry
+	heap      entryHeap
+	seq       uint64
+	inflation float64
+}
+
+type heapEntry struct {
+	key      string
+	freq     int64
+	size     int64
+	priority float64
+	seq      uint64
+	index    int
+}
+
+func newHeapPolicy(sizeAware bool) *heapPolicy {
+	return &heapPolicy{sizeAware: sizeAware, entries: make(map[string]*heapEntry)}
+}
+
+func (p *heapPolicy) Touch(key string, size int64) {
+	p.seq++
+	e, ok := p.entries[key]
+	if !ok {
+		e = &heapEntry{key: key}
+		p.entries[key] = e
+		heap.Push(&p.heap, e)
+	}
+	e.freq++
+	e.size = size
+	e.seq = p.seq
+	e.priority = float64(e.freq)
+	if p.sizeAware {
+		e.priority = p.inflation + float64(e.freq)/float64(max(size, 1))
+	}
+	heap.Fix(&p.heap, e.index)
+}
+
+func (p *heapPolicy) Remove(key string, evicted bool) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	if evicted && p.sizeAware {
+		p.inflation = e.priority
+	}
+	heap.Remove(&p.heap, e.index)
+	delete(p.entries, key)
+}
+
+func (p *heapPolicy) Victim(skip func(string) bool) (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	if skip == nil || !skip(p.heap[0].key) {
+		return p.heap[0].key, true
+	}
+	// Rare, so a scan is good enough
+	var best *heapEntry
+	for _, e := range p.heap {
+		if !skip(e.key) && (best == nil || p.heap.less(e, best)) {
+			best = e
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.key, true
+}
+
+type entryHeap []*heapEntry
+
+func (h entryHeap) less(a, b *heapEntry) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	return a.seq < b.seq
+}
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x any) {
+	e := x.(*heapEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,137 @@
+package evict
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c, _ := New(LRU, 30)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Request(key, 10)
+	}
+	c.Request("a", 10)
+	c.Request("d", 10)
+	if got := c.Evict(nil); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("expected b to be evicted, got %v", got)
+	}
+	inUse := func(key string) bool { return key == "c" }
+	c.Request("e", 10)
+	if got := c.Evict(inUse); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("expected a to be evicted as c is in use, got %v", got)
+	}
+}
+
+func TestLFU(t *testing.T) {
+	c, _ := New(LFU, 30)
+	for _, key := range []string{"a", "a", "a", "b", "c", "c"} {
+		c.Request(key, 10)
+	}
+	c.Request("d", 10)
+	if got := c.Evict(nil); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("expected the least used b to be evicted, got %v", got)
+	}
+}
+
+func TestGDSF(t *testing.T) {
+	c, _ := New(GDSF, 100)
+	c.Request("big", 80)
+	c.Request("big", 80)
+	c.Request("small", 10)
+	c.Request("other", 20)
+	if got := c.Evict(nil); !slices.Equal(got, []string{"big"}) {
+		t.Errorf("expected the big file to be evicted despite two hits, got %v", got)
+	}
+	if c.Used() != 30 {
+		t.Errorf("expected 30 bytes used, got %d", c.Used())
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	c, _ := New(TinyLFU, 100)
+	if c.Request("once", 10) {
+		t.Error("expected a file requested once not to be admitted")
+	}
+	if !c.Request("once", 10) {
+		t.Error("expected a file requested twice to be admitted")
+	}
+	for range 5 {
+		c.Request("hot", 90)
+	}
+	c.Request("cold", 50)
+	if c.Request("cold", 50) {
+		t.Error("expected a file no more popular than the victim not to be admitted")
+	}
+}
+
+// syntheticTrace returns requests for a few hundred small files with
+// Zipf popularity, interleaved with large files requested once.
+func syntheticTrace(n int) []Request {
+	rng := rand.New(rand.NewPCG(1, 2))
+	zipf := rand.NewZipf(rng, 1.1, 1, 499)
+	trace := make([]Request, 0, n)
+	for i := range n {
+		if i%20 == 0 {
+			trace = append(trace, Request{Key: fmt.Sprintf("huge-%d", i), Size: 500 << 20})
+			continue
+		}
+		trace = append(trace, Request{Key: fmt.Sprintf("small-%d", zipf.Uint64()), Size: 5 << 20})
+	}
+	return trace
+}
+
+func TestSimulate(t *testing.T) {
+	trace := syntheticTrace(20000)
+	results := make(map[string]Result)
+	for _, policy := range Policies {
+		res, err := Simulate(policy, 1<<30, trace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[policy] = res
+	}
+	lru := results[LRU].HitRatio()
+	for _, policy := range []string{GDSF, TinyLFU} {
+		if got := results[policy].HitRatio(); got <= lru {
+			t.Errorf("expected %s to beat lru's hit ratio %.3f when large files are requested once, got %.3f", policy, lru, got)
+		}
+	}
+}
+
+// BenchmarkPolicies replays a trace against every policy and reports
+// their hit ratios. Set EVICT_TRACE to an access log and
+// EVICT_MAX_SIZE to a cache size in bytes to compare them on recorded
+// traffic.
+func BenchmarkPolicies(b *testing.B) {
+	trace := syntheticTrace(20000)
+	maxSize := int64(1 << 30)
+	if name := os.Getenv("EVICT_TRACE"); name != "" {
+		in, err := os.Open(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		trace, err = ReadAccessLog(in)
+		_ = in.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if size := os.Getenv("EVICT_MAX_SIZE"); size != "" {
+		if _, err := fmt.Sscan(size, &maxSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, policy := range Policies {
+		b.Run(policy, func(b *testing.B) {
+			var res Result
+			for b.Loop() {
+				res, _ = Simulate(policy, maxSize, trace)
+			}
+			b.ReportMetric(res.HitRatio(), "hit-ratio")
+			b.ReportMetric(res.ByteHitRatio(), "byte-hit-ratio")
+		})
+	}
+}
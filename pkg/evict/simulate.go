@@ -0,0 +1,88 @@
+package evict
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// Request is a request for a file in a trace.
+type Request struct {
+	Key  string
+	Size int64
+}
+
+// Result summarises how a policy served a trace.
+type Result struct {
+	Policy   string
+	Requests int
+	Hits     int
+	Bytes    int64 // size of the requested files
+	ByteHits int64 // bytes of requests served from the cache
+	Rejected int   // requests not admitted to the cache
+}
+
+// HitRatio returns the fraction of requests served from the cache.
+func (r Result) HitRatio() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Requests)
+}
+
+// ByteHitRatio returns the fraction of bytes served from the cache.
+func (r Result) ByteHitRatio() float64 {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return float64(r.ByteHits) / float64(r.Bytes)
+}
+
+// Simulate replays trace against a cache of maxSize bytes using the
+// named policy. Files are assumed to be cached in full by the request
+// admitting them.
+func Simulate(policy string, maxSize int64, trace []Request) (Result, error) {
+	c, err := New(policy, maxSize)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Policy: policy}
+	for _, req := range trace {
+		res.Requests++
+		res.Bytes += req.Size
+		if c.Contains(req.Key) {
+			res.Hits++
+			res.ByteHits += req.Size
+		}
+		if !c.Request(req.Key, req.Size) {
+			res.Rejected++
+			continue
+		}
+		c.Evict(nil)
+	}
+	return res, nil
+}
+
+// ReadAccessLog reads a trace from JSON access log records as written
+// by the proxy, using their hash and size. Records without them, such
+// as failed requests, are skipped.
+func ReadAccessLog(in io.Reader) ([]Request, error) {
+	var trace []Request
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec struct {
+			Method string `json:"method"`
+			Hash   string `json:"hash"`
+			Size   int64  `json:"size"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.Hash == "" || rec.Size <= 0 || rec.Method == "HEAD" {
+			continue
+		}
+		trace = append(trace, Request{Key: rec.Hash, Size: rec.Size})
+	}
+	return trace, scanner.Err()
+}
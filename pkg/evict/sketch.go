@@ -0,0 +1,73 @@
+package evict
+
+import "hash/maphash"
+
+const (
+	sketchDepth   = 4
+	sketchCounter = 15 // counters are capped like 4 bit counters
+)
+
+// Sketch is a count-min sketch estimating how often keys were seen
+// recently, as used by TinyLFU. Counts are halved once as many keys as
+// ten times the width were counted, so old popularity fades.
+type Sketch struct {
+	seed    maphash.Seed
+	width   uint64
+	rows    [sketchDepth][]uint8
+	added   int
+	resetAt int
+}
+
+// NewSketch returns a Sketch with width counters per row, which should
+// be a few times the number of files expected in the cache.
+func NewSketch(width int) *Sketch {
+	s := &Sketch{seed: maphash.MakeSeed(), width: uint64(max(width, 16)), resetAt: 10 * max(width, 16)}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, s.width)
+	}
+	return s
+}
+
+// indexes returns the counter of key in each row.
+func (s *Sketch) indexes(key string) [sketchDepth]uint64 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) % s.width
+	}
+	return idx
+}
+
+// Increment counts one occurrence of key.
+func (s *Sketch) Increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < sketchCounter {
+			s.rows[i][j]++
+		}
+	}
+	s.added++
+	if s.added >= s.resetAt {
+		s.reset()
+	}
+}
+
+// Estimate returns how often key was seen, possibly too high but never
+// too low.
+func (s *Sketch) Estimate(key string) int {
+	est := sketchCounter
+	for i, j := range s.indexes(key) {
+		est = min(est, int(s.rows[i][j]))
+	}
+	return est
+}
+
+// reset halves every counter.
+func (s *Sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.added /= 2
+}
@@ -0,0 +1,136 @@
+// Package gzseek indexes gzip streams so they can be read from any
+// offset of the decompressed data without decompressing everything
+// before it, in the manner of zlib's zran example.
+//
+// While the stream is decompressed once from its start, a seek point
+// is recorded at the start of a deflate block about every span bytes
+// of output, holding the bit offset of the block and the 32 KiB of
+// output before it which later blocks may refer back to.
+package gzseek
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DefaultSpan is the default distance between seek points. Reading
+// from an offset decompresses at most this much data to reach it.
+const DefaultSpan = 4 << 20
+
+// Point is a position decompression can start from.
+type Point struct {
+	Out    int64  // offset in the decompressed data
+	In     int64  // offset in the gzip stream of the byte the deflate block starts in
+	Bits   uint8  // bits of that byte before the block
+	Window []byte // the output before Out a block may refer to, compressed with flate
+}
+
+// Index lists the seek points of a gzip stream.
+type Index struct {
+	CompressedSize int64 // size of the gzip stream
+	Size           int64 // size of the decompressed data
+	Points         []Point
+}
+
+// Indexer decompresses a gzip stream and builds its index.
+type Indexer struct {
+	f     *inflater
+	span  int64
+	index Index
+	err   error
+}
+
+// NewIndexer returns an Indexer reading the gzip stream r, which may
+// consist of several gzip members, and recording a seek point about
+// every span bytes of output.
+func NewIndexer(r io.Reader, span int64) *Indexer {
+	x := &Indexer{f: newInflater(r, 0), span: span}
+	last := int64(0)
+	x.f.blockStart = func(f *inflater) {
+		if f.out-last < x.span || x.err != nil {
+			return
+		}
+		last = f.out
+		window, err := compress(f.window())
+		if err != nil {
+			x.err = err
+			return
+		}
+		pos := f.bitPos()
+		x.index.Points = append(x.index.Points, Point{Out: f.out, In: pos / 8, Bits: uint8(pos % 8), Window: window})
+	}
+	return x
+}
+
+// Read reads decompressed data.
+func (x *Indexer) Read(p []byte) (int, error) {
+	if x.err != nil {
+		return 0, x.err
+	}
+	n, err := x.f.Read(p)
+	if err == io.EOF {
+		x.index.CompressedSize = x.f.in
+		x.index.Size = x.f.out
+	}
+	return n, err
+}
+
+// Index returns the index of the stream once it has been read to the
+// end, or nil before.
+func (x *Indexer) Index() *Index {
+	if x.f.state != stateEOF {
+		return nil
+	}
+	return &x.index
+}
+
+// NewReader returns a reader of the decompressed data from offset off,
+// reading the gzip stream from ra.
+func (idx *Index) NewReader(ra io.ReaderAt, off int64) (io.Reader, error) {
+	if off < 0 || off > idx.Size {
+		return nil, fmt.Errorf("gzseek: offset %d out of range", off)
+	}
+	i := sort.Search(len(idx.Points), func(i int) bool { return idx.Points[i].Out > off }) - 1
+	var f *inflater
+	if i < 0 {
+		f = newInflater(io.NewSectionReader(ra, 0, idx.CompressedSize), 0)
+	} else {
+		p := idx.Points[i]
+		window, err := io.ReadAll(flate.NewReader(bytes.NewReader(p.Window)))
+		if err != nil {
+			return nil, fmt.Errorf("gzseek: invalid window: %w", err)
+		}
+		f = newInflater(io.NewSectionReader(ra, p.In, idx.CompressedSize-p.In), p.In)
+		if _, err := f.bits(uint(p.Bits)); err != nil {
+			return nil, err
+		}
+		f.win = append(f.win, window...)
+		f.rd = len(f.win)
+		f.out = p.Out
+		f.state = stateBlock
+		off -= p.Out
+	}
+	if _, err := io.CopyN(io.Discard, f, off); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compress compresses a window with flate.
+func compress(window []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(window); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package gzseek
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testData returns n bytes of compressible but irregular text.
+func testData(n int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta", "\n"}
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		if rnd.Intn(50) == 0 {
+			// Incompressible runs make the encoder use stored blocks
+			b := make([]byte, rnd.Intn(2000))
+			rnd.Read(b)
+			buf.Write(b)
+		}
+		fmt.Fprintf(&buf, "%s %d ", words[rnd.Intn(len(words))], rnd.Intn(1000))
+	}
+	return buf.Bytes()[:n]
+}
+
+// gzipped compresses the parts of data as separate gzip members.
+func gzipped(t *testing.T, level int, parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		w, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Name = "part"
+		_, _ = w.Write(part)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestIndex(t *testing.T) {
+	data := testData(3 << 20)
+	for _, test := range []struct {
+		name string
+		gz   []byte
+	}{
+		{"default", gzipped(t, gzip.DefaultCompression, data)},
+		{"huffman only", gzipped(t, gzip.HuffmanOnly, data)},
+		{"stored", gzipped(t, gzip.NoCompression, data[:200000])},
+		{"members", gzipped(t, gzip.BestSpeed, data[:1<<20], data[1<<20:1<<20], data[1<<20:])},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			want := data
+			if test.name == "stored" {
+				want = data[:200000]
+			}
+			x := NewIndexer(bytes.NewReader(test.gz), 64<<10)
+			got, err := io.ReadAll(x)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("decompressed data differs")
+			}
+			idx := x.Index()
+			if idx == nil || idx.Size != int64(len(want)) || idx.CompressedSize != int64(len(test.gz)) {
+				t.Fatalf("unexpected index %+v", idx)
+			}
+			if len(want) > 1<<20 && len(idx.Points) == 0 {
+				t.Error("expected seek points")
+			}
+
+			ra := bytes.NewReader(test.gz)
+			for _, off := range []int64{0, 1, 70000, int64(len(want)) / 2, int64(len(want)) - 10, int64(len(want))} {
+				r, err := idx.NewReader(ra, off)
+				if err != nil {
+					t.Fatalf("offset %d: %v", off, err)
+				}
+				got := make([]byte, min(int64(5000), int64(len(want))-off))
+				if _, err := io.ReadFull(r, got); err != nil {
+					t.Fatalf("offset %d: %v", off, err)
+				}
+				if !bytes.Equal(got, want[off:off+int64(len(got))]) {
+					t.Errorf("offset %d: data differs", off)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexErrors(t *testing.T) {
+	gz := gzipped(t, gzip.DefaultCompression, testData(100000))
+	corrupt := bytes.Clone(gz)
+	corrupt[len(corrupt)-5]++ // the stored size
+	if _, err := io.ReadAll(NewIndexer(bytes.NewReader(corrupt), DefaultSpan)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+	if _, err := io.ReadAll(NewIndexer(bytes.NewReader([]byte("plain text")), DefaultSpan)); !errors.Is(err, ErrHeader) {
+		t.Errorf("expected a header error, got %v", err)
+	}
+	if _, err := io.ReadAll(NewIndexer(bytes.NewReader(gz[:len(gz)/2]), DefaultSpan)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected a truncation error, got %v", err)
+	}
+}
+
+func BenchmarkIndexer(b *testing.B) {
+	data := testData(8 << 20)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		if _, err := io.Copy(io.Discard, NewIndexer(bytes.NewReader(buf.Bytes()), DefaultSpan)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
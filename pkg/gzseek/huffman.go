@@ -0,0 +1,125 @@
+package gzseek
+
+// fastBits is the length of the codes decoded with one table lookup.
+const fastBits = 9
+
+// huffman is a canonical Huffman code of a deflate block.
+type huffman struct {
+	count  [16]uint16 // number of codes of each length
+	symbol []uint16   // symbols in the order of their codes
+
+	// fast maps the next fastBits bits of input, in the order they
+	// are read, to symbol<<4 | length for codes up to fastBits long,
+	// or to 0 if the code is longer.
+	fast [1 << fastBits]uint16
+}
+
+// The codes of fixed Huffman blocks.
+var fixedLit, fixedDist = func() (*huffman, *huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	lit, _ := newHuffman(lengths[:])
+	var dist [30]uint8
+	for i := range dist {
+		dist[i] = 5
+	}
+	d, _ := newHuffman(dist[:])
+	return lit, d
+}()
+
+// newHuffman builds the code of symbols with the given code lengths,
+// where 0 means a symbol isn't used. Incomplete codes are allowed, as
+// some encoders send them for distances, but over-subscribed ones are
+// not.
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+	left := 1
+	for l := 1; l < 16; l++ {
+		left = left<<1 - int(h.count[l])
+		if left < 0 {
+			return nil, errCorrupt
+		}
+	}
+
+	var offs [16]int
+	for l := 1; l < 15; l++ {
+		offs[l+1] = offs[l] + int(h.count[l])
+	}
+	h.symbol = make([]uint16, offs[15]+int(h.count[15]))
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	code, index := 0, 0
+	for l := 1; l <= fastBits; l++ {
+		for i := 0; i < int(h.count[l]); i++ {
+			entry := h.symbol[index]<<4 | uint16(l)
+			// Codes are sent most significant bit first
+			for j := reverse(code, l); j < len(h.fast); j += 1 << l {
+				h.fast[j] = entry
+			}
+			code++
+			index++
+		}
+		code <<= 1
+	}
+	return h, nil
+}
+
+// reverse returns the n bit value code with its bits reversed.
+func reverse(code, n int) int {
+	r := 0
+	for i := 0; i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
+
+// decode reads a symbol of h.
+func (f *inflater) decode(h *huffman) (int, error) {
+	// Near the end of the input fewer bits may be left than needed
+	// for a lookup, so fall back to decoding bit by bit
+	if f.need(fastBits) == nil {
+		if entry := h.fast[f.bitbuf&(1<<fastBits-1)]; entry != 0 {
+			n := uint(entry & 15)
+			f.bitbuf >>= n
+			f.nbits -= n
+			return int(entry >> 4), nil
+		}
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l < 16; l++ {
+		bit, err := f.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= bit
+		count := int(h.count[l])
+		if code-first < count {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errCorrupt
+}
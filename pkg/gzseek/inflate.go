@@ -0,0 +1,442 @@
+package gzseek
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// windowSize is the largest distance a deflate back reference reaches.
+const windowSize = 1 << 15
+
+var (
+	// ErrHeader is returned for data which isn't a gzip stream.
+	ErrHeader = errors.New("gzseek: invalid gzip header")
+
+	// ErrChecksum is returned if a gzip member decompressed from its
+	// start doesn't match its trailer.
+	ErrChecksum = errors.New("gzseek: invalid checksum")
+
+	errCorrupt = errors.New("gzseek: corrupt deflate stream")
+)
+
+// States of an inflater between calls to step.
+const (
+	stateHeader  = iota // at the start of a gzip member
+	stateBlock          // at the start of a deflate block
+	stateStored         // inside a stored block
+	stateHuffman        // inside a compressed block
+	stateTrailer        // after the last block of a member
+	stateEOF            // after the last member
+)
+
+// inflater decompresses a gzip stream, which may consist of several
+// members, while keeping track of the bit position of the input so
+// decompression can be resumed at the start of any deflate block.
+type inflater struct {
+	r      *bufio.Reader
+	in     int64  // offset in the stream of the next byte read from r
+	bitbuf uint32 // bits read from r but not used yet, LSB first
+	nbits  uint
+
+	state  int
+	final  bool // the current block is the last of its member
+	stored int  // bytes left in a stored block
+	lit    *huffman
+	dist   *huffman
+
+	win []byte // decompressed data, the last windowSize bytes of history then the unread bytes
+	rd  int    // offset in win of the first byte not read yet
+	out int64  // offset in the decompressed stream of the end of win
+
+	verify bool // the member was decompressed from its start, so its checksum can be verified
+	crc    uint32
+	size   uint32
+
+	// blockStart is called at the start of every deflate block.
+	blockStart func(f *inflater)
+	err        error
+}
+
+// newInflater returns an inflater of the gzip stream r starting at
+// offset in of the stream.
+func newInflater(r io.Reader, in int64) *inflater {
+	return &inflater{r: bufio.NewReaderSize(r, 64<<10), in: in, win: make([]byte, 0, 4*windowSize)}
+}
+
+// bitPos returns the offset in bits of the next unused bit of input.
+func (f *inflater) bitPos() int64 {
+	return f.in*8 - int64(f.nbits)
+}
+
+// need makes sure there are at least n bits in bitbuf.
+func (f *inflater) need(n uint) error {
+	for f.nbits < n {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		f.in++
+		f.bitbuf |= uint32(b) << f.nbits
+		f.nbits += 8
+	}
+	return nil
+}
+
+// bits returns the next n bits of input, n <= 24.
+func (f *inflater) bits(n uint) (int, error) {
+	if err := f.need(n); err != nil {
+		return 0, err
+	}
+	v := int(f.bitbuf & (1<<n - 1))
+	f.bitbuf >>= n
+	f.nbits -= n
+	return v, nil
+}
+
+// align drops the bits left of the current byte.
+func (f *inflater) align() {
+	f.bitbuf >>= f.nbits % 8
+	f.nbits -= f.nbits % 8
+}
+
+// readByte reads a byte after aligning the input.
+func (f *inflater) readByte() (byte, error) {
+	f.align()
+	b, err := f.bits(8)
+	return byte(b), err
+}
+
+// readFull fills p after aligning the input.
+func (f *inflater) readFull(p []byte) error {
+	f.align()
+	for len(p) > 0 && f.nbits > 0 {
+		b, _ := f.bits(8)
+		p[0] = byte(b)
+		p = p[1:]
+	}
+	n, err := io.ReadFull(f.r, p)
+	f.in += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Read reads decompressed data.
+func (f *inflater) Read(p []byte) (int, error) {
+	for f.rd == len(f.win) {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.err = f.step()
+	}
+	n := copy(p, f.win[f.rd:])
+	f.rd += n
+	return n, nil
+}
+
+// slide drops read history beyond the window from win.
+func (f *inflater) slide() {
+	if drop := min(len(f.win)-windowSize, f.rd); drop > windowSize {
+		n := copy(f.win, f.win[drop:])
+		f.win = f.win[:n]
+		f.rd -= drop
+	}
+}
+
+// window returns the last windowSize bytes of output, or all of it if
+// there is less.
+func (f *inflater) window() []byte {
+	return f.win[max(len(f.win)-windowSize, 0):]
+}
+
+// step decompresses some more data, returning io.EOF after the last
+// gzip member.
+func (f *inflater) step() error {
+	f.slide()
+	start := len(f.win)
+	err := f.decodeStep()
+	if n := len(f.win) - start; n > 0 {
+		f.out += int64(n)
+		if f.verify {
+			f.crc = crc32.Update(f.crc, crc32.IEEETable, f.win[start:])
+			f.size += uint32(n)
+		}
+	}
+	return err
+}
+
+// decodeStep appends some more decompressed data to win.
+func (f *inflater) decodeStep() error {
+	switch f.state {
+	case stateHeader:
+		return f.readHeader()
+	case stateBlock:
+		if f.blockStart != nil {
+			f.blockStart(f)
+		}
+		return f.readBlockHeader()
+	case stateStored:
+		n := min(f.stored, windowSize)
+		start := len(f.win)
+		f.win = append(f.win, make([]byte, n)...)
+		if err := f.readFull(f.win[start:]); err != nil {
+			return err
+		}
+		if f.stored -= n; f.stored == 0 {
+			f.endBlock()
+		}
+		return nil
+	case stateHuffman:
+		return f.decodeSymbols()
+	case stateTrailer:
+		return f.readTrailer()
+	}
+	return io.EOF
+}
+
+// readHeader reads the header of a gzip member. See RFC 1952.
+func (f *inflater) readHeader() error {
+	var hdr [10]byte
+	if err := f.readFull(hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return ErrHeader
+	}
+	flags := hdr[3]
+	if flags&0x04 != 0 { // FEXTRA
+		var xlen [2]byte
+		if err := f.readFull(xlen[:]); err != nil {
+			return err
+		}
+		if err := f.readFull(make([]byte, binary.LittleEndian.Uint16(xlen[:]))); err != nil {
+			return err
+		}
+	}
+	for _, flag := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		for flags&flag != 0 {
+			b, err := f.readByte()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flags&0x02 != 0 { // FHCRC
+		if err := f.readFull(make([]byte, 2)); err != nil {
+			return err
+		}
+	}
+	f.verify, f.crc, f.size = true, 0, 0
+	f.state = stateBlock
+	return nil
+}
+
+// readTrailer checks the trailer of a gzip member and moves on to the
+// next one, if any.
+func (f *inflater) readTrailer() error {
+	var trailer [8]byte
+	if err := f.readFull(trailer[:]); err != nil {
+		return err
+	}
+	if f.verify && (binary.LittleEndian.Uint32(trailer[:4]) != f.crc || binary.LittleEndian.Uint32(trailer[4:]) != f.size) {
+		return ErrChecksum
+	}
+	if _, err := f.r.Peek(1); err == io.EOF && f.nbits == 0 {
+		f.state = stateEOF
+		return io.EOF
+	}
+	f.state = stateHeader
+	return nil
+}
+
+// readBlockHeader reads the header of a deflate block. See RFC 1951.
+func (f *inflater) readBlockHeader() error {
+	header, err := f.bits(3)
+	if err != nil {
+		return err
+	}
+	f.final = header&1 != 0
+	switch header >> 1 {
+	case 0:
+		var lens [4]byte
+		if err := f.readFull(lens[:]); err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint16(lens[:2])
+		if n != ^binary.LittleEndian.Uint16(lens[2:]) {
+			return errCorrupt
+		}
+		f.stored = int(n)
+		f.state = stateStored
+		if n == 0 {
+			f.endBlock()
+		}
+		return nil
+	case 1:
+		f.lit, f.dist = fixedLit, fixedDist
+	case 2:
+		if f.lit, f.dist, err = f.readDynamicTables(); err != nil {
+			return err
+		}
+	default:
+		return errCorrupt
+	}
+	f.state = stateHuffman
+	return nil
+}
+
+// endBlock moves on after the end of a block.
+func (f *inflater) endBlock() {
+	if f.final {
+		f.state = stateTrailer
+	} else {
+		f.state = stateBlock
+	}
+}
+
+// codeLengthOrder is the order code length code lengths are sent in.
+var codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// readDynamicTables reads the Huffman codes of a dynamic block.
+func (f *inflater) readDynamicTables() (*huffman, *huffman, error) {
+	counts, err := f.bits(14)
+	if err != nil {
+		return nil, nil, err
+	}
+	nlen, ndist, ncode := counts&0x1f+257, (counts>>5)&0x1f+1, counts>>10+4
+	if nlen > 286 || ndist > 30 {
+		return nil, nil, errCorrupt
+	}
+	var lengths [320]uint8
+	for i := 0; i < ncode; i++ {
+		n, err := f.bits(3)
+		if err != nil {
+			return nil, nil, err
+		}
+		lengths[codeLengthOrder[i]] = uint8(n)
+	}
+	lencode, err := newHuffman(lengths[:19])
+	if err != nil {
+		return nil, nil, err
+	}
+	clear(lengths[:19])
+
+	for i := 0; i < nlen+ndist; {
+		sym, err := f.decode(lencode)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var repeat int
+		var value uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return nil, nil, errCorrupt
+			}
+			value = lengths[i-1]
+			repeat, err = f.bits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.bits(3)
+			repeat += 3
+		default:
+			repeat, err = f.bits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if i+repeat > nlen+ndist {
+			return nil, nil, errCorrupt
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		// Without an end of block code the block never ends
+		return nil, nil, errCorrupt
+	}
+	lit, err := newHuffman(lengths[:nlen])
+	if err != nil {
+		return nil, nil, err
+	}
+	dist, err := newHuffman(lengths[nlen : nlen+ndist])
+	if err != nil {
+		return nil, nil, err
+	}
+	return lit, dist, nil
+}
+
+// Base lengths and distances of length and distance symbols, and the
+// number of extra bits added to them.
+var (
+	lengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// decodeSymbols decodes the symbols of a compressed block until about
+// a window of output is ready or the block ends.
+func (f *inflater) decodeSymbols() error {
+	for start := len(f.win); len(f.win)-start < windowSize; {
+		sym, err := f.decode(f.lit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			f.win = append(f.win, byte(sym))
+			continue
+		case sym == 256:
+			f.endBlock()
+			return nil
+		}
+		sym -= 257
+		if sym >= 29 {
+			return errCorrupt
+		}
+		extra, err := f.bits(lengthExtra[sym])
+		if err != nil {
+			return err
+		}
+		length := lengthBase[sym] + extra
+		sym, err = f.decode(f.dist)
+		if err != nil {
+			return err
+		}
+		if sym >= 30 {
+			return errCorrupt
+		}
+		if extra, err = f.bits(distExtra[sym]); err != nil {
+			return err
+		}
+		dist := distBase[sym] + extra
+		if dist > len(f.win) {
+			return errCorrupt
+		}
+		// The reference may overlap the bytes it copies
+		from := len(f.win) - dist
+		for i := 0; i < length; i++ {
+			f.win = append(f.win, f.win[from+i])
+		}
+	}
+	return nil
+}
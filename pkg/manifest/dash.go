@@ -0,0 +1,191 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashURIAttrs lists the attributes holding URIs of each DASH element,
+// and whether they are segment templates.
+var dashURIAttrs = map[string]map[string]bool{
+	"SegmentTemplate":     {"media": true, "initialization": true, "index": true, "bitstreamSwitching": true},
+	"SegmentURL":          {"media": false, "index": false},
+	"Initialization":      {"sourceURL": false},
+	"RepresentationIndex": {"sourceURL": false},
+	"BitstreamSwitching":  {"sourceURL": false},
+}
+
+// dashAttrValue matches the quoted value of each attribute in
+// dashURIAttrs within a start tag.
+var dashAttrValue = func() map[string]*regexp.Regexp {
+	res := map[string]*regexp.Regexp{}
+	for _, attrs := range dashURIAttrs {
+		for name := range attrs {
+			res[name] = regexp.MustCompile(`(\s` + name + `\s*=\s*)("[^"]*"|'[^']*')`)
+		}
+	}
+	return res
+}()
+
+// dashURIText lists the elements whose text is a URI.
+var dashURIText = map[string]bool{"BaseURL": true, "Location": true}
+
+// edit replaces the bytes of a manifest from start to end.
+type edit struct {
+	start, end int64
+	text       string
+}
+
+// rewriteDASH rewrites the BaseURL, segment and index URIs of a DASH
+// manifest. The manifest is edited in place, so everything else in it
+// is kept byte for byte.
+func rewriteDASH(body []byte, base *url.URL, rewrite RewriteFunc) (*Result, error) {
+	res := &Result{}
+	d := xml.NewDecoder(bytes.NewReader(body))
+
+	// bases[i] is the base URL of the children of the element at
+	// depth i, and hasBase[i] is true once a BaseURL child set it.
+	bases := []*url.URL{base}
+	hasBase := []bool{false}
+	var edits []edit
+	var textElem string
+	var textStart int64
+	var text strings.Builder
+	for {
+		start := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid DASH manifest: %w", err)
+		}
+		end := d.InputOffset()
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "MPD" {
+				for _, a := range t.Attr {
+					switch a.Name.Local {
+					case "type":
+						res.Live = a.Value == "dynamic"
+					case "minimumUpdatePeriod":
+						res.Refresh, _ = parseISODuration(a.Value)
+					}
+				}
+			}
+			parent := bases[len(bases)-1]
+			bases = append(bases, parent)
+			hasBase = append(hasBase, false)
+			if attrs := dashURIAttrs[t.Name.Local]; attrs != nil {
+				tag := string(body[start:end])
+				edited := tag
+				for _, a := range t.Attr {
+					template, ok := attrs[a.Name.Local]
+					if !ok || a.Name.Space != "" {
+						continue
+					}
+					if target, ok := resolve(parent, a.Value, template); ok {
+						edited = replaceAttr(edited, a.Name.Local, rewrite(target, template))
+					}
+				}
+				if edited != tag {
+					edits = append(edits, edit{start, end, edited})
+				}
+			}
+			if dashURIText[t.Name.Local] {
+				textElem, textStart = t.Name.Local, end
+				text.Reset()
+			}
+		case xml.CharData:
+			if textElem != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if textElem == t.Name.Local {
+				textElem = ""
+				// The element's own entry is the base it was found under
+				own, parent := bases[len(bases)-1], len(bases)-2
+				ref := strings.TrimSpace(text.String())
+				if u, err := url.Parse(ref); err == nil && t.Name.Local == "BaseURL" && !hasBase[parent] {
+					// Alternative BaseURLs after the first are ignored
+					hasBase[parent] = true
+					if own != nil {
+						u = own.ResolveReference(u)
+					}
+					bases[parent] = u
+				}
+				if target, ok := resolve(own, ref, false); ok {
+					edits = append(edits, edit{textStart, start, escapeXML(rewrite(target, false))})
+				}
+			}
+			if len(bases) > 1 {
+				bases = bases[:len(bases)-1]
+				hasBase = hasBase[:len(hasBase)-1]
+			}
+		}
+	}
+	if !res.Live {
+		res.Refresh = 0
+	}
+
+	var out bytes.Buffer
+	var pos int64
+	for _, e := range edits {
+		out.Write(body[pos:e.start])
+		out.WriteString(e.text)
+		pos = e.end
+	}
+	out.Write(body[pos:])
+	res.Body = out.Bytes()
+	return res, nil
+}
+
+// replaceAttr returns tag with the value of its attribute name set to
+// value.
+func replaceAttr(tag, name, value string) string {
+	loc := dashAttrValue[name].FindStringSubmatchIndex(tag)
+	if loc == nil {
+		return tag
+	}
+	return tag[:loc[4]] + `"` + escapeXML(value) + `"` + tag[loc[5]:]
+}
+
+// escapeXML escapes s for use as XML text or a quoted attribute value.
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// isoDuration matches the xs:duration values of DASH manifests, such as
+// PT2S or P0Y0M0DT0H1M30.5S.
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an xs:duration. Years and months are taken
+// as 365 and 30 days.
+func parseISODuration(s string) (time.Duration, error) {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	units := []time.Duration{365 * 24 * time.Hour, 30 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n * float64(unit))
+	}
+	return d, nil
+}
@@ -0,0 +1,64 @@
+package manifest
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hlsURIAttr matches the URI attribute of a tag such as EXT-X-KEY,
+// EXT-X-MAP or EXT-X-MEDIA.
+var hlsURIAttr = regexp.MustCompile(`(^|[:,])(URI=")([^"]*)(")`)
+
+// rewriteHLS rewrites the segment, key and variant URIs of an HLS
+// playlist.
+func rewriteHLS(body []byte, base *url.URL, rewrite RewriteFunc) *Result {
+	res := &Result{}
+	var endList, vod, media bool
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		text := strings.TrimRight(string(line), "\r")
+		eol := string(line[len(text):])
+		switch {
+		case strings.TrimSpace(text) == "":
+			continue
+		case strings.HasPrefix(text, "#EXT"):
+			tag, value, _ := strings.Cut(text, ":")
+			switch tag {
+			case "#EXT-X-TARGETDURATION":
+				media = true
+				if seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && seconds > 0 {
+					res.Refresh = time.Duration(seconds * float64(time.Second))
+				}
+			case "#EXT-X-ENDLIST":
+				endList = true
+			case "#EXT-X-PLAYLIST-TYPE":
+				vod = strings.TrimSpace(value) == "VOD"
+			}
+			text = hlsURIAttr.ReplaceAllStringFunc(text, func(attr string) string {
+				m := hlsURIAttr.FindStringSubmatch(attr)
+				if target, ok := resolve(base, m[3], false); ok {
+					return m[1] + m[2] + rewrite(target, false) + m[4]
+				}
+				return attr
+			})
+		case strings.HasPrefix(text, "#"):
+			// A comment
+			continue
+		default:
+			if target, ok := resolve(base, text, false); ok {
+				text = rewrite(target, false)
+			}
+		}
+		lines[i] = []byte(text + eol)
+	}
+	res.Body = bytes.Join(lines, []byte("\n"))
+	res.Live = media && !endList && !vod
+	if !res.Live {
+		res.Refresh = 0
+	}
+	return res
+}
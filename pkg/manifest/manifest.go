@@ -0,0 +1,112 @@
+// Package manifest rewrites the URIs of HLS playlists and DASH manifests
+// so that players fetch segments, keys and variants through the proxy.
+package manifest
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of manifest understood by Rewrite.
+const (
+	HLS  = "hls"  // HLS playlist, .m3u8
+	DASH = "dash" // DASH media presentation description, .mpd
+)
+
+// Detect returns the kind of manifest of a file with contentType whose
+// URL path is name, or an empty string if it is none. The extension of
+// name is only used if the content type is missing or generic.
+func Detect(contentType, name string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch strings.ToLower(mediaType) {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+		return HLS
+	case "application/dash+xml":
+		return DASH
+	case "", "application/octet-stream", "text/plain", "binary/octet-stream":
+	default:
+		return ""
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u8":
+		return HLS
+	case ".mpd":
+		return DASH
+	}
+	return ""
+}
+
+// RewriteFunc returns the URI a rewritten manifest refers to target
+// by. target is an absolute http or https URL. If template is true it
+// is a DASH segment template whose $...$ identifiers the player fills
+// in, so they must be kept as they are.
+type RewriteFunc func(target string, template bool) string
+
+// Result is a rewritten manifest.
+type Result struct {
+	Body []byte
+
+	// Live is true if the manifest is updated while it is played,
+	// as for an HLS media playlist without EXT-X-ENDLIST or a dynamic
+	// DASH manifest.
+	Live bool
+
+	// Refresh is how long a live manifest stays current: the target
+	// duration of an HLS playlist or the minimum update period of a
+	// DASH manifest. It is zero if the manifest gives none.
+	Refresh time.Duration
+}
+
+// Rewrite rewrites the URIs of the manifest of kind in body with
+// rewrite, after resolving them against base, the URL of the manifest.
+// URIs which aren't http or https, such as data: or skd: key URIs, are
+// left as they are.
+func Rewrite(kind string, body []byte, base *url.URL, rewrite RewriteFunc) (*Result, error) {
+	switch kind {
+	case HLS:
+		return rewriteHLS(body, base, rewrite), nil
+	case DASH:
+		return rewriteDASH(body, base, rewrite)
+	}
+	return nil, fmt.Errorf("unknown manifest kind %q", kind)
+}
+
+// resolve resolves ref against base, returning false unless the result
+// is an http or https URL. The $...$ identifiers of a template are
+// kept as they are.
+func resolve(base *url.URL, ref string, template bool) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return "", false
+	}
+	var identifiers []string
+	if template {
+		// Identifiers such as $Number%05d$ don't parse as part of a URL
+		parts := strings.Split(ref, "$")
+		for i := 1; i < len(parts); i += 2 {
+			identifiers = append(identifiers, "$"+parts[i]+"$")
+			parts[i] = "tmpl" + strconv.Itoa(len(identifiers)-1) + "x"
+		}
+		ref = strings.Join(parts, "")
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	resolved := u.String()
+	for i := len(identifiers) - 1; i >= 0; i-- {
+		resolved = strings.ReplaceAll(resolved, "tmpl"+strconv.Itoa(i)+"x", identifiers[i])
+	}
+	return resolved, true
+}
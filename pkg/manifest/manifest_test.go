@@ -0,0 +1,154 @@
+package manifest
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxied rewrites target as a /stream?url= URL, marking templates.
+func proxied(target string, template bool) string {
+	if template {
+		return "/tmpl?url=" + target
+	}
+	return "/stream?url=" + url.QueryEscape(target)
+}
+
+func TestDetect(t *testing.T) {
+	for _, test := range []struct {
+		contentType, name, want string
+	}{
+		{"application/vnd.apple.mpegurl", "/live", HLS},
+		{"application/x-mpegURL; charset=utf-8", "/index", HLS},
+		{"application/dash+xml", "/manifest", DASH},
+		{"", "/live/index.m3u8", HLS},
+		{"application/octet-stream", "/vod/stream.MPD", DASH},
+		{"video/mp4", "/video.m3u8", ""},
+		{"", "/video.mp4", ""},
+	} {
+		if got := Detect(test.contentType, test.name); got != test.want {
+			t.Errorf("%q %s: expected %q, got %q", test.contentType, test.name, test.want, got)
+		}
+	}
+}
+
+func TestRewriteHLS(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/live/a/index.m3u8?token=1")
+	playlist := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1`,
+		`#EXT-X-MAP:URI="/init.mp4"`,
+		"# a comment",
+		"#EXTINF:6.0,",
+		"seg1.ts",
+		"#EXTINF:6.0,",
+		"https://other.example.com/seg2.ts\r",
+		`#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://key"`,
+		"",
+	}, "\n")
+	res, err := Rewrite(HLS, []byte(playlist), base, proxied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		`#EXT-X-KEY:METHOD=AES-128,URI="/stream?url=https%3A%2F%2Fcdn.example.com%2Flive%2Fa%2Fkey.bin",IV=0x1`,
+		`#EXT-X-MAP:URI="/stream?url=https%3A%2F%2Fcdn.example.com%2Finit.mp4"`,
+		"# a comment",
+		"#EXTINF:6.0,",
+		"/stream?url=https%3A%2F%2Fcdn.example.com%2Flive%2Fa%2Fseg1.ts",
+		"#EXTINF:6.0,",
+		"/stream?url=https%3A%2F%2Fother.example.com%2Fseg2.ts\r",
+		`#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://key"`,
+		"",
+	}, "\n")
+	if string(res.Body) != want {
+		t.Errorf("unexpected playlist:\n%s", res.Body)
+	}
+	if !res.Live || res.Refresh != 6*time.Second {
+		t.Errorf("expected a live playlist refreshed every 6s, got %v %v", res.Live, res.Refresh)
+	}
+
+	res, _ = Rewrite(HLS, []byte(playlist+"#EXT-X-ENDLIST\n"), base, proxied)
+	if res.Live || res.Refresh != 0 {
+		t.Errorf("expected a finished playlist not to be live, got %v %v", res.Live, res.Refresh)
+	}
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nlow/index.m3u8\n"
+	res, _ = Rewrite(HLS, []byte(master), base, proxied)
+	if res.Live || !strings.Contains(string(res.Body), "\n/stream?url=https%3A%2F%2Fcdn.example.com%2Flive%2Fa%2Flow%2Findex.m3u8\n") {
+		t.Errorf("unexpected master playlist:\n%s", res.Body)
+	}
+}
+
+func TestRewriteDASH(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/vod/manifest.mpd")
+	mpd := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2.5S">
+  <Location>https://cdn.example.com/vod/manifest.mpd?v=2</Location>
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media='$RepresentationID$/$Number%05d$.m4s'/>
+      <Representation id="720p" bandwidth="3000000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <Representation id="en">
+        <BaseURL>https://audio.example.com/en.mp4?a=1&amp;b=2</BaseURL>
+        <SegmentList>
+          <Initialization sourceURL="init.mp4"/>
+          <SegmentURL media="seg1.m4s"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+	res, err := Rewrite(DASH, []byte(mpd), base, proxied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(res.Body)
+	for _, want := range []string{
+		`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2.5S">`,
+		`<Location>/stream?url=https%3A%2F%2Fcdn.example.com%2Fvod%2Fmanifest.mpd%3Fv%3D2</Location>`,
+		`<BaseURL>/stream?url=https%3A%2F%2Fcdn.example.com%2Fvod%2Fmedia%2F</BaseURL>`,
+		`initialization="/tmpl?url=https://cdn.example.com/vod/media/$RepresentationID$/init.mp4"`,
+		`media="/tmpl?url=https://cdn.example.com/vod/media/$RepresentationID$/$Number%05d$.m4s"/>`,
+		`<Representation id="720p" bandwidth="3000000"/>`,
+		`<BaseURL>/stream?url=https%3A%2F%2Faudio.example.com%2Fen.mp4%3Fa%3D1%26b%3D2</BaseURL>`,
+		`<Initialization sourceURL="/stream?url=https%3A%2F%2Faudio.example.com%2Finit.mp4"/>`,
+		`<SegmentURL media="/stream?url=https%3A%2F%2Faudio.example.com%2Fseg1.m4s"/>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in:\n%s", want, body)
+		}
+	}
+	if !res.Live || res.Refresh != 2500*time.Millisecond {
+		t.Errorf("expected a live manifest refreshed every 2.5s, got %v %v", res.Live, res.Refresh)
+	}
+
+	if _, err := Rewrite(DASH, []byte("<MPD><Period id=1></MPD>"), base, proxied); err == nil {
+		t.Error("expected an error for a malformed manifest")
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"PT2S":               2 * time.Second,
+		"PT1M30.5S":          90500 * time.Millisecond,
+		"P0Y0M0DT0H0M4.000S": 4 * time.Second,
+		"P1D":                24 * time.Hour,
+	} {
+		if got, err := parseISODuration(s); err != nil || got != want {
+			t.Errorf("%s: expected %v, got %v %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"", "P", "PT", "2S"} {
+		if _, err := parseISODuration(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package vfsproxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Where the bytes of a response came from, as reported in access logs.
+const (
+	sourceCache    = "cache"
+	sourcePartial  = "partial"
+	sourceUpstream = "upstream"
+	sourceBypass   = "bypass" // streamed without entering the cache
+)
+
+// AccessLogger writes one structured record per request.
+type AccessLogger struct {
+	Logger *slog.Logger
+
+	// Sample is the fraction of requests to log, between 0 and 1.
+	// Server errors are always logged. Zero logs every request.
+	Sample float64
+}
+
+// NewAccessLogger returns an AccessLogger writing JSON records to w.
+// Requests are logged at NOTICE level and server errors at ERROR, so
+// level can be taken from the rclone log level.
+func NewAccessLogger(w io.Writer, level slog.Leveler, sample float64) *AccessLogger {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == fs.SlogLevelNotice {
+				a.Value = slog.StringValue("NOTICE")
+			}
+			return a
+		},
+	})
+	return &AccessLogger{Logger: slog.New(h), Sample: sample}
+}
+
+type accessInfoKey struct{}
+
+// accessInfo is filled in by the Handler while serving a request.
+type accessInfo struct {
+	user   string
+	tenant string
+	url    string
+	hash   string
+	size   int64
+	source string
+}
+
+// accessInfoFrom returns the accessInfo of the request ctx belongs to,
+// or nil if it is not being logged.
+func accessInfoFrom(ctx context.Context) *accessInfo {
+	info, _ := ctx.Value(accessInfoKey{}).(*accessInfo)
+	return info
+}
+
+// Wrap returns a handler which serves requests with next and logs them.
+func (l *AccessLogger) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &accessInfo{}
+		rec := &responseRecorder{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, info)))
+		l.log(r, rec, info)
+	})
+}
+
+func (l *AccessLogger) log(r *http.Request, rec *responseRecorder, info *accessInfo) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	level := fs.SlogLevelNotice
+	if status >= 500 {
+		level = slog.LevelError
+	} else if l.Sample > 0 && l.Sample < 1 && rand.Float64() >= l.Sample {
+		return
+	}
+	ctx := r.Context()
+	if !l.Logger.Enabled(ctx, level) {
+		return
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	attrs := []slog.Attr{
+		slog.String("client_ip", clientIP),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+	}
+	if info.user != "" {
+		attrs = append(attrs, slog.String("user", info.user))
+	}
+	if info.tenant != "" {
+		attrs = append(attrs, slog.String("tenant", info.tenant))
+	}
+	if info.url != "" {
+		attrs = append(attrs, slog.String("url", redactURL(info.url)))
+	}
+	if info.hash != "" {
+		attrs = append(attrs, slog.String("hash", info.hash))
+	}
+	if info.size > 0 {
+		attrs = append(attrs, slog.Int64("size", info.size))
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		attrs = append(attrs, slog.String("range", rng))
+	}
+	attrs = append(attrs,
+		slog.Int("status", status),
+		slog.Int64("bytes", rec.bytes),
+		slog.Float64("duration_ms", milliseconds(time.Since(rec.start))),
+	)
+	if !rec.first.IsZero() {
+		attrs = append(attrs, slog.Float64("ttfb_ms", milliseconds(rec.first.Sub(rec.start))))
+	}
+	if info.source != "" {
+		attrs = append(attrs, slog.String("source", info.source))
+	}
+	l.Logger.LogAttrs(ctx, level, "request", attrs...)
+}
+
+// redactURL removes the query and credentials from rawURL as they
+// often carry access tokens.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// responseRecorder records the status, size and time to first byte of
+// a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	start  time.Time
+	first  time.Time
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+		rec.first = time.Now()
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.first = time.Now()
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) Flush() {
+	_ = http.NewResponseController(rec.ResponseWriter).Flush()
+}
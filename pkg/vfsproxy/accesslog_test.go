@@ -0,0 +1,53 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+	var buf bytes.Buffer
+	logger := NewAccessLogger(&buf, slog.LevelInfo, 1)
+	srv := logger.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Serve(w, r, upstream.URL+"/file.bin?token=secret")
+	}))
+
+	for _, want := range []string{sourceUpstream, sourceCache} {
+		buf.Reset()
+		r := httptest.NewRequest("GET", "/stream", nil)
+		r.Header.Set("Range", "bytes=0-99")
+		srv.ServeHTTP(httptest.NewRecorder(), r)
+
+		var rec map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Fatalf("failed to decode access log %q: %v", buf.String(), err)
+		}
+		if rec["level"] != "NOTICE" {
+			t.Errorf("expected NOTICE level, got %v", rec["level"])
+		}
+		if rec["source"] != want {
+			t.Errorf("expected source %q, got %v", want, rec["source"])
+		}
+		if rec["status"] != float64(http.StatusPartialContent) || rec["bytes"] != float64(100) {
+			t.Errorf("unexpected status or size in %v", rec)
+		}
+		if rec["url"] != upstream.URL+"/file.bin" {
+			t.Errorf("expected query to be redacted, got %v", rec["url"])
+		}
+		if _, ok := rec["ttfb_ms"]; !ok {
+			t.Errorf("expected time to first byte in %v", rec)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package vfsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// AdminHandler returns an http.Handler serving the admin API. Routes are
+// relative to where it is mounted, so use http.StripPrefix:
+//
+//	GET  /entries    registered links, including deduplication aliases
+//	GET  /coverage   cached ranges of registered links, ?match=hash or url
+//	POST /verify     check cached data against known checksums, see Verify
+//	GET  /pins       pinned files, see Pins
+//	POST /pins       pin {"target": url or hash, "tenant": name}, see Pin
+//	DELETE /pins     unpin a file given like for POST, see Unpin
+func (h *Handler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /entries", h.serveEntries)
+	mux.HandleFunc("GET /coverage", h.serveCoverage)
+	mux.HandleFunc("POST /verify", h.serveVerify)
+	mux.HandleFunc("GET /pins", h.servePins)
+	mux.HandleFunc("POST /pins", h.servePin)
+	mux.HandleFunc("DELETE /pins", h.serveUnpin)
+	return mux
+}
+
+func (h *Handler) serveEntries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, link.Entries())
+}
+
+func (h *Handler) serveCoverage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.Coverage(r.URL.Query().Get("match")))
+}
+
+func (h *Handler) serveVerify(w http.ResponseWriter, r *http.Request) {
+	report, err := h.Verify(r.Context())
+	if err != nil {
+		fs.Errorf(nil, "Cache verify failed: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, "Cache verify failed")
+		return
+	}
+	writeJSON(w, report)
+}
+
+func (h *Handler) servePins(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.Pins())
+}
+
+// pinRequest is the body of requests to pin or unpin a file.
+type pinRequest struct {
+	Target string `json:"target"`
+	Tenant string `json:"tenant"`
+}
+
+func readPinRequest(w http.ResponseWriter, r *http.Request) (pinRequest, bool) {
+	var req pinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Target == "" {
+		WriteError(w, r, http.StatusBadRequest, "Expected JSON with a target")
+		return req, false
+	}
+	return req, true
+}
+
+func (h *Handler) servePin(w http.ResponseWriter, r *http.Request) {
+	req, ok := readPinRequest(w, r)
+	if !ok {
+		return
+	}
+	info, err := h.Pin(req.Tenant, req.Target)
+	if err != nil {
+		fs.Errorf(nil, "Pin failed: %v", err)
+		WriteError(w, r, http.StatusBadRequest, "Pin failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, info)
+}
+
+func (h *Handler) serveUnpin(w http.ResponseWriter, r *http.Request) {
+	req, ok := readPinRequest(w, r)
+	if !ok {
+		return
+	}
+	switch err := h.Unpin(req.Tenant, req.Target); {
+	case errors.Is(err, errPinNotFound):
+		WriteError(w, r, http.StatusNotFound, "Not pinned")
+	case err != nil:
+		fs.Errorf(nil, "Unpin failed: %v", err)
+		WriteError(w, r, http.StatusBadRequest, "Unpin failed: "+err.Error())
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fs.Errorf(nil, "Failed to write JSON response: %v", err)
+	}
+}
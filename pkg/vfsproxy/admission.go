@@ -0,0 +1,118 @@
+package vfsproxy
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// admissionPolicy decides which files may enter the cache. Files it
+// rejects are streamed from the upstream.
+type admissionPolicy struct {
+	minSize     fs.SizeSuffix // -1 for no limit
+	maxSize     fs.SizeSuffix // -1 for no limit
+	types       []string
+	bypassHosts []string
+}
+
+// newAdmissionPolicy returns the policy described by opt, or nil if
+// every file is admitted.
+func newAdmissionPolicy(opt *Options) (*admissionPolicy, error) {
+	a := &admissionPolicy{minSize: -1, maxSize: -1}
+	for _, limit := range []struct {
+		name  string
+		value string
+		size  *fs.SizeSuffix
+	}{
+		{"min size", opt.AdmitMinSize, &a.minSize},
+		{"max size", opt.AdmitMaxSize, &a.maxSize},
+	} {
+		if limit.value == "" {
+			continue
+		}
+		if err := limit.size.Set(limit.value); err != nil {
+			return nil, fmt.Errorf("invalid admission %s: %w", limit.name, err)
+		}
+	}
+	for _, pattern := range opt.AdmitTypes {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid content type pattern %q: %w", pattern, err)
+		}
+		a.types = append(a.types, pattern)
+	}
+	for _, pattern := range opt.BypassHosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+		a.bypassHosts = append(a.bypassHosts, pattern)
+	}
+	if a.minSize < 0 && a.maxSize < 0 && len(a.types) == 0 && len(a.bypassHosts) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// reject returns why a file of size bytes and contentType from
+// targetURL may not be cached, or an empty string if it may.
+func (a *admissionPolicy) reject(size int64, contentType, targetURL string) string {
+	switch {
+	case a.minSize >= 0 && size >= 0 && size < int64(a.minSize):
+		return fmt.Sprintf("smaller than %v", a.minSize)
+	case a.maxSize >= 0 && size < 0:
+		return "unknown size"
+	case a.maxSize >= 0 && size > int64(a.maxSize):
+		return fmt.Sprintf("larger than %v", a.maxSize)
+	}
+	if len(a.types) > 0 {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !matchAny(a.types, mediaType) {
+			return fmt.Sprintf("content type %q not admitted", contentType)
+		}
+	}
+	if len(a.bypassHosts) > 0 {
+		if u, err := url.Parse(targetURL); err == nil && matchAny(a.bypassHosts, strings.ToLower(u.Hostname())) {
+			return fmt.Sprintf("host %s bypasses the cache", u.Hostname())
+		}
+	}
+	return ""
+}
+
+// matchAny reports whether name matches one of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// admit reports whether obj, at remote in ns, may be served through the
+// cache. Files with data in the cache already, such as pinned files,
+// are always served from it.
+func (h *Handler) admit(ctx context.Context, ns *namespace, remote string, obj fs.Object) bool {
+	c := diskCache(ns.vfs)
+	if c == nil {
+		return true
+	}
+	cached := isCached(c, remote)
+	if !cached && h.admission != nil {
+		targetURL, _ := link.Load(ns.hashOf(remote))
+		if reason := h.admission.reject(obj.Size(), fs.MimeType(ctx, obj), targetURL); reason != "" {
+			fs.Debugf(remote, "Not caching: %s", reason)
+			return false
+		}
+	}
+	if ns.evictor != nil && obj.Size() >= 0 {
+		return ns.evictor.request(remote, obj.Size()) || cached
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionPolicy(t *testing.T) {
+	opt := DefaultOptions()
+	if a, err := newAdmissionPolicy(&opt); a != nil || err != nil {
+		t.Fatalf("expected no policy without rules, got %+v, %v", a, err)
+	}
+
+	opt.AdmitMinSize = "1K"
+	opt.AdmitMaxSize = "1G"
+	opt.AdmitTypes = []string{"video/*", "Application/VND.Apple.MpegURL"}
+	opt.BypassHosts = []string{"*.private.example.com"}
+	a, err := newAdmissionPolicy(&opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		size        int64
+		contentType string
+		url         string
+		admit       bool
+	}{
+		{1 << 20, "video/mp4", "https://cdn.example.com/a.mp4", true},
+		{1 << 20, "application/vnd.apple.mpegurl; charset=utf-8", "https://cdn.example.com/a.m3u8", true},
+		{100, "video/mp4", "https://cdn.example.com/a.mp4", false},
+		{2 << 30, "video/mp4", "https://cdn.example.com/a.mp4", false},
+		{-1, "video/mp4", "https://cdn.example.com/a.mp4", false},
+		{1 << 20, "text/html", "https://cdn.example.com/a.html", false},
+		{1 << 20, "", "https://cdn.example.com/a", false},
+		{1 << 20, "video/mp4", "https://a.private.example.com:8443/a.mp4", false},
+	} {
+		reason := a.reject(test.size, test.contentType, test.url)
+		if (reason == "") != test.admit {
+			t.Errorf("%d %q %s: expected admit %v, got reason %q", test.size, test.contentType, test.url, test.admit, reason)
+		}
+	}
+
+	opt.BypassHosts = []string{"[bad"}
+	if _, err := newAdmissionPolicy(&opt); err == nil {
+		t.Error("expected an error for a bad host pattern")
+	}
+}
+
+func TestServeNotAdmitted(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.AdmitMinSize = "1M"
+	h := newTestHandler(t, opt)
+
+	r := httptest.NewRequest("GET", "/stream", nil)
+	r.Header.Set("Range", "bytes=9990-")
+	w := httptest.NewRecorder()
+	h.Serve(w, r, upstream.URL+"/small.mp4")
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[9990:]) {
+		t.Fatalf("expected the range from the upstream, got %d %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+		t.Errorf("expected the upstream content type, got %q", got)
+	}
+	if cachedOnDisk(h, upstream.URL+"/small.mp4") {
+		t.Error("expected a file below the min size not to be cached")
+	}
+}
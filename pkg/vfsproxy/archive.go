@@ -0,0 +1,143 @@
+package vfsproxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/ranges"
+	"github.com/rclone/rclone/vfs"
+)
+
+// ArchiveMember describes a file or directory in an archive.
+type ArchiveMember struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified,omitzero"`
+	Dir      bool      `json:"dir,omitempty"`
+}
+
+// archiveFormats serve the members of archives by format, as named in
+// the path of archive requests.
+var archiveFormats = map[string]func(h *Handler, w http.ResponseWriter, r *http.Request, a *archive, member string){
+	"zip": (*Handler).serveZip,
+	"tar": (*Handler).serveTar,
+}
+
+// archive is an archive opened through the VFS, or read from the
+// upstream if it may not be cached.
+type archive struct {
+	ns     *namespace
+	remote string
+	file   *vfs.File
+	obj    fs.Object
+	in     io.ReaderAt
+	cached bool // in is read through the cache
+}
+
+// ServeArchive serves member of the archive at targetURL in format,
+// zip or tar, which may be gzip compressed, or lists the members as JSON
+// if member is empty. The parts of the archive needed are read through
+// the VFS cache, or with ranged requests to the upstream for archives
+// the client, the admission rules or the cache policy keep out of it.
+func (h *Handler) ServeArchive(w http.ResponseWriter, r *http.Request, targetURL, format, member string) {
+	serve, ok := archiveFormats[format]
+	if !ok {
+		if h.ServeCORS(w, r) {
+			return
+		}
+		WriteError(w, r, http.StatusNotFound, "Unknown archive format")
+		return
+	}
+	h.serveLink(w, r, targetURL, "vfsproxy.ServeArchive", func(r *http.Request, remote string) {
+		ctx := r.Context()
+		ns := h.namespace(ctx)
+		directives := parseClientDirectives(r)
+		if directives.onlyIfCached {
+			if c := diskCache(ns.vfs); c == nil || !isCached(c, remote) {
+				WriteError(w, r, http.StatusGatewayTimeout, "Not cached")
+				return
+			}
+		} else if directives.noCache {
+			ns.revalidate(remote)
+		}
+		file, obj, ok := lookup(w, r, ns, remote)
+		if !ok {
+			return
+		}
+		if obj.Size() < 0 {
+			WriteError(w, r, http.StatusBadGateway, "Can't read archives of unknown length")
+			return
+		}
+		// Members may be anywhere in the archive, so only archives
+		// cached in full are known to be served without the upstream
+		if directives.onlyIfCached && cacheSource(ns.vfs, remote, ranges.Range{Size: file.Size()}) != sourceCache {
+			WriteError(w, r, http.StatusGatewayTimeout, "Not cached")
+			return
+		}
+
+		a := &archive{ns: ns, remote: remote, file: file, obj: obj}
+		if directives.noStore || !h.admit(ctx, ns, remote, obj) {
+			if info := accessInfoFrom(ctx); info != nil {
+				info.source = sourceBypass
+			}
+			in := &objectReaderAt{r: objectReader{ctx: ctx, obj: obj, size: obj.Size()}}
+			defer func() {
+				_ = in.Close()
+			}()
+			a.in = in
+			serve(h, w, r, a, strings.TrimPrefix(member, "/"))
+			return
+		}
+
+		in, err := file.Open(os.O_RDONLY)
+		if err != nil {
+			serveError(w, r, remote, err)
+			return
+		}
+		defer func() {
+			_ = in.Close()
+			if ns.evictor != nil {
+				ns.evictor.wake()
+			}
+		}()
+		a.in, a.cached = in, true
+		serve(h, w, r, a, strings.TrimPrefix(member, "/"))
+	})
+}
+
+// setMemberHeaders sets the Content-Type and Content-Disposition of
+// the archive member name.
+func setMemberHeaders(w http.ResponseWriter, name string) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if v := mime.FormatMediaType("inline", map[string]string{"filename": path.Base(name)}); v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+}
+
+// serveMemberStream serves the member name of a of size read from in,
+// which can't seek, so Range requests get the whole member.
+func serveMemberStream(w http.ResponseWriter, r *http.Request, a *archive, name string, size int64, modTime time.Time, in io.Reader) {
+	setMemberHeaders(w, name)
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	if n, err := io.Copy(w, in); err != nil {
+		fs.Errorf(a.remote, "Didn't finish writing archive member %s (wrote %d/%d bytes): %v", name, n, size, err)
+	}
+}
@@ -0,0 +1,294 @@
+package vfsproxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveArchive requests member of the archive at target from h.
+func serveArchive(h *Handler, target, format, member string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/stream", nil)
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeArchive(w, r, target, format, member)
+	return w
+}
+
+func TestServeZip(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	text := strings.Repeat("compressible text ", 1000)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name    string
+		method  uint16
+		content string
+	}{
+		{"docs/", zip.Store, ""},
+		{"docs/readme.txt", zip.Deflate, text},
+		{"data/blob.json", zip.Store, `{"answer": 42}`},
+	} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method, Modified: modified})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write([]byte(f.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := buf.Bytes()
+		if r.URL.Path == "/plain.txt" {
+			content = []byte("not an archive")
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+	target := upstream.URL + "/bundle.zip"
+
+	w := serveArchive(h, target, "zip", "")
+	var members []ArchiveMember
+	if err := json.NewDecoder(w.Body).Decode(&members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 || !members[0].Dir || members[1] != (ArchiveMember{Name: "docs/readme.txt", Size: int64(len(text)), Modified: modified}) {
+		t.Errorf("unexpected members %+v", members)
+	}
+
+	w = serveArchive(h, target, "zip", "docs/readme.txt", "Range", "bytes=0-9")
+	if w.Code != http.StatusOK || w.Body.String() != text || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("expected the whole deflated member, got %d %s %q", w.Code, w.Header(), w.Body.String()[:min(w.Body.Len(), 40)])
+	}
+
+	w = serveArchive(h, target, "zip", "/data/blob.json", "Range", "bytes=1-8")
+	if w.Code != http.StatusPartialContent || w.Body.String() != `"answer"` || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a range of the stored member, got %d %s %q", w.Code, w.Header(), w.Body)
+	}
+
+	for member, code := range map[string]int{"missing.txt": http.StatusNotFound, "docs/": http.StatusNotFound} {
+		if w := serveArchive(h, target, "zip", member); w.Code != code {
+			t.Errorf("%s: expected %d, got %d", member, code, w.Code)
+		}
+	}
+	if w := serveArchive(h, target, "rar", "a"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown format, got %d", w.Code)
+	}
+	if w := serveArchive(h, upstream.URL+"/plain.txt", "zip", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for a file which isn't a ZIP archive, got %d", w.Code)
+	}
+}
+
+func TestServeTar(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 400000)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "./docs/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: modified},
+		{Name: "./docs/readme.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5, ModTime: modified},
+		{Name: "./docs/latest", Typeflag: tar.TypeSymlink, Linkname: "readme.txt", ModTime: modified},
+		{Name: "./data/big.bin", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(big)), ModTime: modified},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Name {
+		case "./docs/readme.txt":
+			_, _ = tw.Write([]byte("hello"))
+		case "./data/big.bin":
+			_, _ = tw.Write(big)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(buf.Bytes())
+	_ = zw.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := buf.Bytes()
+		switch r.URL.Path {
+		case "/bundle.tar.gz":
+			content = gz.Bytes()
+		case "/plain.txt":
+			content = []byte(strings.Repeat("not an archive ", 100))
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+	for _, name := range []string{"/bundle.tar", "/bundle.tar.gz"} {
+		target := upstream.URL + name
+
+		w := serveArchive(h, target, "tar", "")
+		var members []ArchiveMember
+		if err := json.NewDecoder(w.Body).Decode(&members); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(members) != 4 || !members[0].Dir || members[1] != (ArchiveMember{Name: "docs/readme.txt", Size: 5, Modified: modified}) {
+			t.Errorf("%s: unexpected members %+v", name, members)
+		}
+
+		w = serveArchive(h, target, "tar", "docs/readme.txt")
+		if w.Code != http.StatusOK || w.Body.String() != "hello" || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Errorf("%s: expected the member, got %d %s %q", name, w.Code, w.Header(), w.Body)
+		}
+		w = serveArchive(h, target, "tar", "data/big.bin", "Range", "bytes=5000000-5000015")
+		if w.Code != http.StatusPartialContent || w.Body.String() != string(big[5000000:5000016]) {
+			t.Errorf("%s: expected a range of the member, got %d %q", name, w.Code, w.Body)
+		}
+		for member, code := range map[string]int{"docs/latest": http.StatusNotFound, "docs": http.StatusNotFound, "missing": http.StatusNotFound} {
+			if w := serveArchive(h, target, "tar", member); w.Code != code {
+				t.Errorf("%s %s: expected %d, got %d", name, member, code, w.Code)
+			}
+		}
+	}
+
+	saved, _ := filepath.Glob(filepath.Join(h.archives.dir, "*", "*.idx"))
+	if len(saved) != 2 {
+		t.Errorf("expected the indexes of both archives to be saved, got %v", saved)
+	}
+	for _, name := range saved {
+		if index, err := readTarIndex(name); err != nil || len(index.Members) != 4 || index.Fingerprint == "" {
+			t.Errorf("unexpected saved index %+v: %v", index, err)
+		}
+	}
+
+	if w := serveArchive(h, upstream.URL+"/plain.txt", "tar", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for a file which isn't a tar archive, got %d", w.Code)
+	}
+}
+
+func TestServeArchiveNotAdmitted(t *testing.T) {
+	text := strings.Repeat("compressible text ", 1000)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create("docs/readme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write([]byte(text))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var unranged atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") == "" {
+			unranged.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(buf.Bytes()))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.BypassHosts = []string{"127.0.0.1"}
+	h := newTestHandler(t, opt)
+	target := upstream.URL + "/bundle.zip"
+	if w := serveArchive(h, target, "zip", "docs/readme.txt"); w.Code != http.StatusOK || w.Body.String() != text {
+		t.Fatalf("expected the member from the upstream, got %d %q", w.Code, w.Body.String()[:min(w.Body.Len(), 40)])
+	}
+	if cachedOnDisk(h, target) {
+		t.Error("expected an archive from a bypassed host not to be cached")
+	}
+	if n := unranged.Load(); n != 0 {
+		t.Errorf("expected only ranged reads of the archive, got %d whole file requests", n)
+	}
+
+	h = newTestHandler(t, DefaultOptions())
+	if w := serveArchive(h, target, "zip", "docs/readme.txt", "Cache-Control", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 for an archive which isn't cached, got %d", w.Code)
+	}
+	if w := serveArchive(h, target, "zip", "docs/readme.txt", "Cache-Control", "no-store"); w.Code != http.StatusOK || w.Body.String() != text {
+		t.Fatalf("expected the member from the upstream, got %d", w.Code)
+	}
+	if cachedOnDisk(h, target) {
+		t.Error("expected a no-store request not to cache the archive")
+	}
+}
+
+func TestArchiveIndexSweep(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Name: "readme.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5})
+	_, _ = tw.Write([]byte("hello"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Last-Modified, so the link's modification time changes
+		// with every metadata fetch
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	}))
+	defer upstream.Close()
+	target := upstream.URL + "/bundle.tar"
+	indexOf := func(h *Handler) (string, string) {
+		ns := h.namespace(context.Background())
+		remote := h.remotePath(ns, h.getFileHash(httptest.NewRequest("GET", "/stream", nil), "", target))
+		return remote, h.archives.path(ns, remote)
+	}
+	saved := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	h := newTestHandler(t, DefaultOptions())
+	if w := serveArchive(h, target, "tar", "readme.txt"); w.Body.String() != "hello" {
+		t.Fatalf("expected the member, got %d %q", w.Code, w.Body)
+	}
+	remote, name := indexOf(h)
+	e := h.archives.entry(name)
+	built := e.index
+	if w := serveArchive(h, target, "tar", "readme.txt", "Cache-Control", "no-cache"); w.Body.String() != "hello" {
+		t.Fatalf("expected the member, got %d %q", w.Code, w.Body)
+	}
+	if e.index != built {
+		t.Error("expected the index to be reused after the metadata was fetched again")
+	}
+	h.archives.sweep(h.namespaces())
+	if !saved(name) || h.Status().Archives == nil {
+		t.Fatal("expected the index of a cached archive to be kept")
+	}
+	diskCache(h.namespace(context.Background()).vfs).Remove(remote)
+	h.archives.sweep(h.namespaces())
+	if saved(name) || h.Status().Archives != nil {
+		t.Error("expected the index to be removed with the archive")
+	}
+
+	opt := DefaultOptions()
+	opt.BypassHosts = []string{"127.0.0.1"}
+	h = newTestHandler(t, opt)
+	if w := serveArchive(h, target, "tar", "readme.txt"); w.Body.String() != "hello" {
+		t.Fatalf("expected the member, got %d %q", w.Code, w.Body)
+	}
+	_, name = indexOf(h)
+	h.archives.sweep(h.namespaces())
+	if !saved(name) {
+		t.Fatal("expected the index of an archive read past the cache to be kept while used")
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(name, old, old)
+	h.archives.sweep(h.namespaces())
+	if saved(name) {
+		t.Error("expected an unused index to be removed after the max age")
+	}
+}
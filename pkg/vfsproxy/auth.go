@@ -0,0 +1,91 @@
+package vfsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/pkg/auth"
+)
+
+// newAuthenticator builds the Authenticator described by opt, or
+// returns nil if authentication is not configured.
+func newAuthenticator(opt *Options) (auth.Authenticator, error) {
+	var chain auth.Chain
+	if len(opt.AuthTokens) > 0 {
+		tokens := make(map[string]string, len(opt.AuthTokens))
+		for i, value := range opt.AuthTokens {
+			name, token, ok := strings.Cut(value, ":")
+			if !ok {
+				name, token = fmt.Sprintf("token%d", i+1), value
+			}
+			if token == "" {
+				return nil, errors.New("empty auth token")
+			}
+			tokens[name] = token
+		}
+		chain = append(chain, auth.NewTokens(tokens))
+	}
+	if opt.AuthJWKS != "" {
+		j, err := auth.NewJWT(opt.AuthJWKS, opt.AuthJWTIssuer, opt.AuthJWTAudience, opt.AuthHostsClaim)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, j)
+	}
+	if opt.AuthHtpasswd != "" {
+		h, err := auth.NewHtpasswd(opt.AuthHtpasswd)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, h)
+	}
+	if len(chain) == 0 {
+		if len(opt.AuthAllowHosts) > 0 {
+			return nil, errors.New("allowed hosts need an authentication method")
+		}
+		return nil, nil
+	}
+	if len(opt.AuthAllowHosts) == 0 {
+		return chain, nil
+	}
+	hosts := make(map[string][]string, len(opt.AuthAllowHosts))
+	for _, value := range opt.AuthAllowHosts {
+		name, list, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid allowed hosts %q, want name=host1,host2", value)
+		}
+		hosts[name] = append(hosts[name], strings.Split(list, ",")...)
+	}
+	return auth.RestrictHosts(chain, hosts), nil
+}
+
+// authenticate identifies the client of r with h.Auth, replying 401 if
+// that fails.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Identity, bool) {
+	id, err := h.Auth.Authenticate(r)
+	if err != nil {
+		fs.Infof(nil, "%s: authentication failed: %v", r.RemoteAddr, err)
+		if ch, ok := h.Auth.(auth.Challenger); ok && ch.Challenge() != "" {
+			w.Header().Set("WWW-Authenticate", ch.Challenge())
+		}
+		WriteError(w, r, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	if info := accessInfoFrom(r.Context()); info != nil {
+		info.user = id.Name
+	}
+	return id, true
+}
+
+// hostAllowed returns true if id may fetch targetURL.
+func hostAllowed(id *auth.Identity, targetURL string) bool {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return false
+	}
+	return id.AllowsHost(u.Hostname())
+}
@@ -0,0 +1,90 @@
+package vfsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	var upstreamAuth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Authorization", "Cookie", "X-Hop", "Proxy-Authorization"} {
+			upstreamAuth = append(upstreamAuth, r.Header.Get(name))
+		}
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader("hello"))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.AuthTokens = []string{"alice:alice-token", "bob:bob-token"}
+	opt.AuthAllowHosts = []string{"bob=cdn.example.com"}
+	h := newTestHandler(t, opt)
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/stream", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.Header.Set("Cookie", "session=proxy")
+		r.Header.Set("Connection", "X-Hop")
+		r.Header.Set("X-Hop", "1")
+		r.Header.Set("Proxy-Authorization", "Basic cHJveHk=")
+		w := httptest.NewRecorder()
+		h.Serve(w, r, upstream.URL+"/file.txt")
+		return w
+	}
+
+	w := serve("")
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("expected 401 with a Bearer challenge, got %d %v", w.Code, w.Header())
+	}
+	if w := serve("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unknown token, got %d", w.Code)
+	}
+	if w := serve("bob-token"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for host not allowed, got %d", w.Code)
+	}
+	if w := serve("alice-token"); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("expected 200, got %d %q", w.Code, w.Body)
+	}
+	for _, got := range upstreamAuth {
+		if got != "" {
+			t.Errorf("client credentials leaked to the upstream: %q", got)
+		}
+	}
+}
+
+func TestAuthRedirect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader("internal"))
+	}))
+	defer target.Close()
+	// The client may fetch from 127.0.0.1 only, which redirects to localhost
+	_, port, _ := strings.Cut(strings.TrimPrefix(target.URL, "http://"), ":")
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+port+r.URL.Path, http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	opt := DefaultOptions()
+	opt.AuthTokens = []string{"alice:alice-token", "bob:bob-token"}
+	opt.AuthAllowHosts = []string{"bob=127.0.0.1"}
+	h := newTestHandler(t, opt)
+
+	serve := func(token, name string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/stream", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.Serve(w, r, redirector.URL+"/"+name)
+		return w
+	}
+	if w := serve("bob-token", "bob.txt"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a redirect to a host not allowed, got %d %q", w.Code, w.Body)
+	}
+	if w := serve("alice-token", "alice.txt"); w.Code != http.StatusOK || w.Body.String() != "internal" {
+		t.Errorf("expected 200 for a client allowed any host, got %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,119 @@
+package vfsproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/lib/ranges"
+	"github.com/rclone/rclone/vfs"
+	"github.com/rclone/rclone/vfs/vfscache"
+	"github.com/rclone/rclone/vfs/vfscommon"
+)
+
+// diskCache returns the disk cache of v, or nil if caching is off.
+// rclone keeps it in an unexported field, so it is read by reflection.
+// A second vfscache.New on the same directory would race with the one
+// the VFS uses, so there is no supported alternative; TestDiskCache
+// fails if rclone moves the field.
+func diskCache(v *vfs.VFS) *vfscache.Cache {
+	f := reflect.ValueOf(v).Elem().FieldByName("cache")
+	if !f.IsValid() || f.Type() != reflect.TypeFor[*vfscache.Cache]() || f.IsNil() {
+		return nil
+	}
+	return (*vfscache.Cache)(f.UnsafePointer())
+}
+
+// cacheRoots returns the directories holding the cached data and the
+// per item metadata of c.
+func cacheRoots(c *vfscache.Cache) (dataRoot, metaRoot string) {
+	stats := c.Stats()
+	dataRoot, _ = stats["path"].(string)
+	metaRoot, _ = stats["pathMeta"].(string)
+	return dataRoot, metaRoot
+}
+
+// isCached reports whether c holds data of the file at remote.
+func isCached(c *vfscache.Cache, remote string) bool {
+	dataRoot, _ := cacheRoots(c)
+	_, err := os.Stat(filepath.Join(dataRoot, filepath.FromSlash(remote)))
+	return err == nil
+}
+
+// readCacheInfo reads the metadata the VFS cache persists for the item
+// called name. It is written when the item is closed, so it may lag
+// behind for files which are currently open.
+func readCacheInfo(c *vfscache.Cache, name string) (vfscache.Info, error) {
+	var info vfscache.Info
+	_, metaRoot := cacheRoots(c)
+	in, err := os.Open(filepath.Join(metaRoot, filepath.FromSlash(name)))
+	if err != nil {
+		return info, err
+	}
+	defer in.Close()
+	err = json.NewDecoder(in).Decode(&info)
+	return info, err
+}
+
+// cacheSource reports whether serving rng of remote from v will be
+// answered from the disk cache, the upstream or partly from both.
+func cacheSource(v *vfs.VFS, remote string, rng ranges.Range) string {
+	c := diskCache(v)
+	if c == nil || v.Opt.CacheMode < vfscommon.CacheModeFull || rng.Size <= 0 {
+		return sourceUpstream
+	}
+	// c.Item adds an item for files which were never cached
+	if !isCached(c, remote) {
+		return sourceUpstream
+	}
+	item := c.Item(remote)
+	if item.HasRange(rng) {
+		return sourceCache
+	}
+	// FindMissing clips to the size of the cached file
+	switch missing := item.FindMissing(rng); {
+	case !missing.IsEmpty() && missing != rng:
+		return sourcePartial
+	default:
+		return sourceUpstream
+	}
+}
+
+// requestRange returns the bytes of a file of size requested by the
+// Range header value, or the whole file unless it names a single range.
+func requestRange(header string, size int64) ranges.Range {
+	whole := ranges.Range{Pos: 0, Size: size}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return whole
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return whole
+	}
+	if start == "" {
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n <= 0 {
+			return whole
+		}
+		n = min(n, size)
+		return ranges.Range{Pos: size - n, Size: n}
+	}
+	pos, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || pos < 0 || pos >= size {
+		return whole
+	}
+	last := size - 1
+	if end != "" {
+		if e, err := strconv.ParseInt(end, 10, 64); err == nil && e < last {
+			last = e
+		}
+	}
+	if last < pos {
+		return whole
+	}
+	return ranges.Range{Pos: pos, Size: last - pos + 1}
+}
@@ -0,0 +1,50 @@
+package vfsproxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rclone/rclone/lib/ranges"
+)
+
+func TestDiskCache(t *testing.T) {
+	h := newTestHandler(t, Options{})
+	if diskCache(h.namespace(context.Background()).vfs) == nil {
+		t.Fatal("expected the disk cache of the VFS, check the field rclone keeps it in")
+	}
+}
+
+func TestCacheSourceUncached(t *testing.T) {
+	h := newTestHandler(t, Options{})
+	ns := h.namespace(context.Background())
+	rng := ranges.Range{Pos: 0, Size: 100}
+	if got := cacheSource(ns.vfs, "ne/never-cached", rng); got != sourceUpstream {
+		t.Errorf("expected %s, got %s", sourceUpstream, got)
+	}
+	if got := pinCached(ns, "ne/never-cached", 100); got != 0 {
+		t.Errorf("expected nothing cached, got %d", got)
+	}
+	if files := diskCache(ns.vfs).Stats()["files"]; files != 0 {
+		t.Errorf("expected no cache items to be created, got %v", files)
+	}
+}
+
+func TestRequestRange(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		want   ranges.Range
+	}{
+		{"", ranges.Range{Pos: 0, Size: 100}},
+		{"bytes=10-19", ranges.Range{Pos: 10, Size: 10}},
+		{"bytes=90-", ranges.Range{Pos: 90, Size: 10}},
+		{"bytes=90-200", ranges.Range{Pos: 90, Size: 10}},
+		{"bytes=-5", ranges.Range{Pos: 95, Size: 5}},
+		{"bytes=0-1,5-6", ranges.Range{Pos: 0, Size: 100}},
+		{"bytes=200-", ranges.Range{Pos: 0, Size: 100}},
+		{"items=1-2", ranges.Range{Pos: 0, Size: 100}},
+	} {
+		if got := requestRange(test.header, 100); got != test.want {
+			t.Errorf("requestRange(%q) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package vfsproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// clientDirectives are the cache directives of a client request.
+type clientDirectives struct {
+	noCache      bool // revalidate with the upstream before serving
+	noStore      bool // stream from the upstream without caching
+	onlyIfCached bool // fail unless served from the cache alone
+}
+
+// parseClientDirectives returns the directives of r from its
+// Cache-Control header, a Pragma: no-cache header without it, or a
+// nocache query parameter.
+func parseClientDirectives(r *http.Request) clientDirectives {
+	var d clientDirectives
+	cacheControl := r.Header.Values("Cache-Control")
+	for _, v := range cacheControl {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-cache":
+				d.noCache = true
+			case "max-age":
+				d.noCache = d.noCache || strings.Trim(value, `"`) == "0"
+			case "no-store":
+				d.noStore = true
+			case "only-if-cached":
+				d.onlyIfCached = true
+			}
+		}
+	}
+	if len(cacheControl) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		d.noCache = true
+	}
+	switch r.URL.Query().Get("nocache") {
+	case "", "0", "false":
+	default:
+		d.noCache = true
+	}
+	return d
+}
@@ -0,0 +1,84 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseClientDirectives(t *testing.T) {
+	for _, test := range []struct {
+		header http.Header
+		query  string
+		want   clientDirectives
+	}{
+		{http.Header{}, "", clientDirectives{}},
+		{http.Header{"Cache-Control": {"No-Cache"}}, "", clientDirectives{noCache: true}},
+		{http.Header{"Cache-Control": {"max-age=0, no-store"}}, "", clientDirectives{noCache: true, noStore: true}},
+		{http.Header{"Cache-Control": {"max-age=60", "only-if-cached"}}, "", clientDirectives{onlyIfCached: true}},
+		{http.Header{"Pragma": {"no-cache"}}, "", clientDirectives{noCache: true}},
+		{http.Header{"Pragma": {"no-cache"}, "Cache-Control": {"max-age=60"}}, "", clientDirectives{}},
+		{http.Header{}, "?nocache=1", clientDirectives{noCache: true}},
+		{http.Header{}, "?nocache=0", clientDirectives{}},
+	} {
+		r := httptest.NewRequest("GET", "/stream"+test.query, nil)
+		r.Header = test.header
+		if got := parseClientDirectives(r); got != test.want {
+			t.Errorf("%v %s: expected %+v, got %+v", test.header, test.query, test.want, got)
+		}
+	}
+}
+
+func TestServeClientDirectives(t *testing.T) {
+	var mu sync.Mutex
+	content, modTime := []byte("first version"), time.Unix(1700000000, 0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		body, mod := content, modTime
+		mu.Unlock()
+		http.ServeContent(w, r, "", mod, bytes.NewReader(body))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+	get := func(name string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/stream", nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.Serve(w, r, upstream.URL+name)
+		return w
+	}
+
+	if w := get("/file", "Cache-Control", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 for a file never cached, got %d", w.Code)
+	}
+	if w := get("/file"); w.Body.String() != "first version" {
+		t.Fatalf("unexpected body %q", w.Body)
+	}
+	if w := get("/file", "Cache-Control", "only-if-cached"); w.Code != http.StatusOK || w.Body.String() != "first version" {
+		t.Errorf("expected the cached file, got %d %q", w.Code, w.Body)
+	}
+
+	mu.Lock()
+	content, modTime = []byte("second version"), modTime.Add(time.Hour)
+	mu.Unlock()
+	if w := get("/file"); w.Body.String() != "first version" {
+		t.Errorf("expected the cached version without directives, got %q", w.Body)
+	}
+	if w := get("/file", "Cache-Control", "no-cache"); w.Body.String() != "second version" {
+		t.Errorf("expected no-cache to fetch the changed file, got %q", w.Body)
+	}
+
+	w := get("/other", "Cache-Control", "no-store", "Range", "bytes=7-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "version" {
+		t.Errorf("expected the range from the upstream, got %d %q", w.Code, w.Body)
+	}
+	if cachedOnDisk(h, upstream.URL+"/other") {
+		t.Error("expected no-store to keep the file out of the cache")
+	}
+}
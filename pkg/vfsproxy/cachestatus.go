@@ -0,0 +1,173 @@
+package vfsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// responseHeaderer is implemented by objects which keep the header of
+// the upstream response, such as link.Object.
+type responseHeaderer interface {
+	ResponseHeader() http.Header
+}
+
+// cacheControlRule sets the Cache-Control header of files from upstream
+// URLs matching pattern.
+type cacheControlRule struct {
+	pattern *regexp.Regexp
+	value   string
+}
+
+// parseCacheControlRules parses rules given as host[/path]=value, where
+// * matches any characters.
+func parseCacheControlRules(specs []string) ([]cacheControlRule, error) {
+	var rules []cacheControlRule
+	for _, spec := range specs {
+		pattern, value, ok := strings.Cut(spec, "=")
+		pattern, value = strings.TrimSpace(pattern), strings.TrimSpace(value)
+		if !ok || pattern == "" || value == "" {
+			return nil, fmt.Errorf("invalid cache control rule %q: want host[/path]=value", spec)
+		}
+		host, urlPath, hasPath := strings.Cut(pattern, "/")
+		if !hasPath {
+			urlPath = "*"
+		}
+		re := "^" + globRegexp(strings.ToLower(host)) + "/" + globRegexp(urlPath) + "$"
+		rules = append(rules, cacheControlRule{pattern: regexp.MustCompile(re), value: value})
+	}
+	return rules, nil
+}
+
+// globRegexp returns a regular expression matching what glob does when
+// * matches any characters.
+func globRegexp(glob string) string {
+	return strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*")
+}
+
+// cacheControlFor returns the Cache-Control value the rules set for
+// targetURL, if any.
+func (h *Handler) cacheControlFor(targetURL string) (string, bool) {
+	if len(h.cacheControl) == 0 {
+		return "", false
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", false
+	}
+	name := strings.ToLower(u.Hostname()) + "/" + strings.TrimPrefix(u.EscapedPath(), "/")
+	for _, rule := range h.cacheControl {
+		if rule.pattern.MatchString(name) {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
+
+// setFreshnessHeaders sets Age, Cache-Control and Expires for obj at
+// remote. Cache-Control and Expires are passed through from the
+// upstream unless a rule overrides them. Age counts from when the
+// upstream last answered for the file.
+func (h *Handler) setFreshnessHeaders(w http.ResponseWriter, ns *namespace, obj fs.Object, remote string) {
+	var upstream http.Header
+	if o, ok := obj.(responseHeaderer); ok {
+		upstream = o.ResponseHeader()
+	}
+	hdr := w.Header()
+	now := time.Now()
+	age, hasAge := responseAge(upstream, now)
+	if hasAge {
+		hdr.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+
+	targetURL, _ := link.Load(ns.hashOf(remote))
+	if value, ok := h.cacheControlFor(targetURL); ok {
+		hdr.Set("Cache-Control", value)
+		if maxAge, ok := cacheControlMaxAge(value); ok {
+			hdr.Set("Expires", now.Add(maxAge-age).UTC().Format(http.TimeFormat))
+		}
+		return
+	}
+	for _, name := range []string{"Cache-Control", "Expires"} {
+		if v := upstream.Get(name); v != "" {
+			hdr.Set(name, v)
+		}
+	}
+}
+
+// responseAge returns the age of the upstream response with header, its
+// own Age plus the time since its Date.
+func responseAge(header http.Header, now time.Time) (time.Duration, bool) {
+	var age time.Duration
+	upstreamAge, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	hasAge := err == nil && upstreamAge >= 0
+	if hasAge {
+		age = time.Duration(upstreamAge) * time.Second
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		age += max(now.Sub(date), 0)
+		hasAge = true
+	}
+	return age, hasAge
+}
+
+// cacheControlMaxAge returns the max-age of a Cache-Control value.
+func cacheControlMaxAge(value string) (time.Duration, bool) {
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(arg, `"`), 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// xCache is the X-Cache header value of each source.
+var xCache = map[string]string{
+	sourceCache:    "HIT",
+	sourcePartial:  "PARTIAL",
+	sourceUpstream: "MISS",
+	sourceBypass:   "BYPASS",
+}
+
+// cacheStatus is the RFC 9211 Cache-Status parameters of each source.
+var cacheStatus = map[string]string{
+	sourceCache:    "hit",
+	sourcePartial:  "fwd=partial; stored",
+	sourceUpstream: "fwd=miss; stored",
+	sourceBypass:   "fwd=bypass",
+}
+
+// setCacheStatus reports in the X-Cache and Cache-Status headers of w
+// where the response comes from.
+func (h *Handler) setCacheStatus(w http.ResponseWriter, source string) {
+	w.Header().Set("X-Cache", xCache[source])
+	w.Header().Set("Cache-Status", h.cacheName+"; "+cacheStatus[source])
+}
+
+// cacheStatusName returns name as the cache name of a Cache-Status
+// header, quoted unless it is a valid token.
+func cacheStatusName(name string) string {
+	if name == "" {
+		return "rclone-vfs"
+	}
+	for i, c := range name {
+		isAlpha := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !isAlpha && (i == 0 && c != '*' || !strings.ContainsRune("0123456789:/!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(name)
+		}
+	}
+	return name
+}
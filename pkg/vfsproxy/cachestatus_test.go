@@ -0,0 +1,87 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheControlRules(t *testing.T) {
+	h := &Handler{}
+	var err error
+	h.cacheControl, err = parseCacheControlRules([]string{
+		"cdn.example.com/live/*.m3u8=no-cache",
+		"cdn.example.com/vod/*=public, max-age=86400",
+		"*.example.org=private",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for url, want := range map[string]string{
+		"https://cdn.example.com/live/a/index.m3u8?token=1": "no-cache",
+		"https://CDN.example.com:8443/vod/a/b.mp4":          "public, max-age=86400",
+		"https://media.example.org/anything":                "private",
+		"https://cdn.example.com/live/a/segment.ts":         "",
+		"https://example.org/anything":                      "",
+	} {
+		if got, _ := h.cacheControlFor(url); got != want {
+			t.Errorf("%s: expected %q, got %q", url, want, got)
+		}
+	}
+
+	if _, err := parseCacheControlRules([]string{"cdn.example.com"}); err == nil {
+		t.Error("expected an error for a rule without a value")
+	}
+	if got := cacheStatusName("edge cache"); got != `"edge cache"` {
+		t.Errorf("expected a quoted cache name, got %s", got)
+	}
+}
+
+func TestServeFreshnessHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+		w.Header().Set("Age", "5")
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		w.Header().Set("Expires", "Thu, 01 Jan 2065 00:00:00 GMT")
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader([]byte("data")))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.CacheHeader = true
+	opt.CacheControl = []string{"*/override=max-age=100"}
+	h := newTestHandler(t, opt)
+	get := func(name string) http.Header {
+		w := httptest.NewRecorder()
+		h.Serve(w, httptest.NewRequest("GET", "/stream", nil), upstream.URL+name)
+		return w.Header()
+	}
+
+	hdr := get("/file")
+	if age, _ := strconv.Atoi(hdr.Get("Age")); age < 65 || age > 70 {
+		t.Errorf("expected the upstream age plus the time since its date, got %q", hdr.Get("Age"))
+	}
+	if hdr.Get("Cache-Control") != "public, max-age=600" || hdr.Get("Expires") != "Thu, 01 Jan 2065 00:00:00 GMT" {
+		t.Errorf("expected the upstream freshness headers, got %v", hdr)
+	}
+	name := "vfsproxy-" + t.Name()
+	if hdr.Get("Cache-Status") != name+"; fwd=miss; stored" {
+		t.Errorf("expected a miss, got %q", hdr.Get("Cache-Status"))
+	}
+	if hdr := get("/file"); hdr.Get("Cache-Status") != name+"; hit" {
+		t.Errorf("expected a hit, got %q", hdr.Get("Cache-Status"))
+	}
+
+	hdr = get("/override")
+	if hdr.Get("Cache-Control") != "max-age=100" {
+		t.Errorf("expected the overridden Cache-Control, got %q", hdr.Get("Cache-Control"))
+	}
+	// The response is 65 seconds old, so it expires in 35
+	expires, err := http.ParseTime(hdr.Get("Expires"))
+	if left := time.Until(expires); err != nil || left < 25*time.Second || left > 40*time.Second {
+		t.Errorf("expected Expires in about 35s, got %q", hdr.Get("Expires"))
+	}
+}
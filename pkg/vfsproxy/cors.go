@@ -0,0 +1,84 @@
+package vfsproxy
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy describes which cross-origin requests are allowed.
+type corsPolicy struct {
+	origins       []string
+	anyOrigin     bool
+	allowHeaders  string
+	exposeHeaders string
+	credentials   bool
+	maxAge        time.Duration
+}
+
+// newCORSPolicy returns the policy described by opt, or nil if CORS is
+// disabled.
+func newCORSPolicy(opt *Options, maxAge time.Duration) *corsPolicy {
+	if len(opt.CORSOrigins) == 0 {
+		return nil
+	}
+	return &corsPolicy{
+		origins:       opt.CORSOrigins,
+		anyOrigin:     slices.Contains(opt.CORSOrigins, "*"),
+		allowHeaders:  strings.Join(opt.CORSAllowHeaders, ", "),
+		exposeHeaders: strings.Join(opt.CORSExposeHeaders, ", "),
+		credentials:   opt.CORSCredentials,
+		maxAge:        maxAge,
+	}
+}
+
+func (c *corsPolicy) allowed(origin string) bool {
+	return c.anyOrigin || slices.ContainsFunc(c.origins, func(o string) bool {
+		return strings.EqualFold(o, origin)
+	})
+}
+
+// ServeCORS sets the CORS headers for r and answers preflight requests.
+// It returns true if the response has been written.
+func (h *Handler) ServeCORS(w http.ResponseWriter, r *http.Request) bool {
+	c := h.cors
+	origin := r.Header.Get("Origin")
+	if c == nil || origin == "" {
+		return false
+	}
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	hdr := w.Header()
+	allowOrigin := origin
+	if c.anyOrigin && !c.credentials {
+		allowOrigin = "*"
+	} else {
+		hdr.Add("Vary", "Origin")
+	}
+	if c.allowed(origin) {
+		hdr.Set("Access-Control-Allow-Origin", allowOrigin)
+		if c.credentials {
+			hdr.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			hdr.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			if c.allowHeaders != "" {
+				hdr.Set("Access-Control-Allow-Headers", c.allowHeaders)
+			}
+			if c.maxAge > 0 {
+				hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+			}
+		} else if c.exposeHeaders != "" {
+			hdr.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+		}
+	}
+	if preflight {
+		// Disallowed origins get no CORS headers, so the browser
+		// blocks the actual request.
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
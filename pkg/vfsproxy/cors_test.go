@@ -0,0 +1,78 @@
+package vfsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader("some video"))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.CORSOrigins = []string{"https://player.example"}
+	h := newTestHandler(t, opt)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", "/stream", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		r.Header.Set("Access-Control-Request-Headers", "range")
+		w := httptest.NewRecorder()
+		h.Serve(w, r, "")
+		return w
+	}
+
+	w := preflight("https://player.example")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for preflight, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://player.example" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Range") {
+		t.Errorf("expected Range to be allowed, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("unexpected Access-Control-Max-Age %q", got)
+	}
+
+	w = preflight("https://evil.example")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected preflight from other origin to get no CORS headers, got %d %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/stream", nil)
+	r.Header.Set("Origin", "https://player.example")
+	r.Header.Set("Range", "bytes=0-3")
+	w = httptest.NewRecorder()
+	h.Serve(w, r, upstream.URL+"/video.mp4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "some" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body)
+	}
+	for _, name := range []string{"Content-Range", "X-Cache", "Cache-Status", "Age"} {
+		if got := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, name) {
+			t.Errorf("expected %s to be exposed, got %q", name, got)
+		}
+	}
+	if got := w.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("expected Vary: Origin, got %q", got)
+	}
+}
+
+func TestCORSZeroOptions(t *testing.T) {
+	h := newTestHandler(t, Options{CORSOrigins: []string{"*"}})
+	r := httptest.NewRequest("OPTIONS", "/stream", nil)
+	r.Header.Set("Origin", "https://player.example")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	h.Serve(w, r, "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Max-Age") != "" {
+		t.Errorf("expected a preflight response without max age, got %d %s", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,105 @@
+package vfsproxy
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/rclone/rclone/lib/ranges"
+	"github.com/rclone/rclone/vfs/vfscache"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// Coverage describes how much of a registered file is in the cache.
+type Coverage struct {
+	Hash       string      `json:"hash"`
+	Tenant     string      `json:"tenant,omitempty"`
+	URL        string      `json:"url"`
+	Size       int64       `json:"size"` // -1 if unknown
+	Cached     int64       `json:"cached"`
+	Percent    float64     `json:"percent"`
+	Ranges     []ByteRange `json:"ranges"`
+	InUse      bool        `json:"in_use,omitempty"`
+	LastAccess time.Time   `json:"last_access,omitzero"`
+}
+
+// ByteRange is a range of bytes of a file.
+type ByteRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Coverage returns the cache coverage of every registered file, or of
+// those whose hash or URL is match if it is not empty. The ranges of
+// open files are those saved when they were last opened, extended by
+// the part cached from the start of the file since.
+func (h *Handler) Coverage(match string) []Coverage {
+	out := []Coverage{}
+	for _, info := range link.Entries() {
+		if match != "" && match != info.Remote && match != info.URL {
+			continue
+		}
+		ns := h.entryNamespace(info.Tenant)
+		if ns == nil {
+			continue
+		}
+		cov := Coverage{Hash: info.Remote, Tenant: info.Tenant, URL: info.URL, Size: info.Size, Ranges: []ByteRange{}}
+		if c := diskCache(ns.vfs); c != nil {
+			cached := info.Remote
+			if info.Alias != "" {
+				// Deduplicated links are cached as their alias
+				cached = info.Alias
+			}
+			fileCoverage(c, h.remotePath(ns, cached), &cov)
+		}
+		out = append(out, cov)
+	}
+	return out
+}
+
+// entryNamespace returns the namespace links registered for tenant are
+// served from, or nil if there is none.
+func (h *Handler) entryNamespace(tenant string) *namespace {
+	if h.tenantFrom == "" {
+		if tenant != "" {
+			return nil
+		}
+		return h.namespace(context.Background())
+	}
+	return h.tenants[tenant]
+}
+
+// fileCoverage fills in cov from the item at remote in c.
+func fileCoverage(c *vfscache.Cache, remote string, cov *Coverage) {
+	if !isCached(c, remote) {
+		return
+	}
+	var rs ranges.Ranges
+	if info, err := readCacheInfo(c, remote); err == nil {
+		rs = info.Rs
+		cov.LastAccess = info.ATime
+		if cov.Size < 0 {
+			cov.Size = info.Size
+		}
+	}
+	cov.InUse = c.InUse(remote)
+	if cov.InUse && cov.Size > 0 {
+		whole := ranges.Range{Pos: 0, Size: cov.Size}
+		if missing := c.Item(remote).FindMissing(whole); missing.Pos > 0 {
+			rs.Insert(ranges.Range{Pos: 0, Size: missing.Pos})
+		}
+	}
+	for _, r := range rs {
+		if cov.Size >= 0 {
+			r.Clip(cov.Size)
+		}
+		if r.IsEmpty() {
+			continue
+		}
+		cov.Ranges = append(cov.Ranges, ByteRange{Offset: r.Pos, Length: r.Size})
+		cov.Cached += r.Size
+	}
+	if cov.Size > 0 {
+		cov.Percent = math.Round(1000*float64(cov.Cached)/float64(cov.Size)) / 10
+	}
+}
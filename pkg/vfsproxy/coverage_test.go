@@ -0,0 +1,58 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCoverage(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.CacheHeader = true
+	h := newTestHandler(t, opt)
+	target := upstream.URL + "/video.mp4"
+
+	for _, want := range []string{"MISS", "HIT"} {
+		w := httptest.NewRecorder()
+		h.Serve(w, httptest.NewRequest("GET", "/stream", nil), target)
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("expected X-Cache %s, got %q", want, got)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.Serve(w, httptest.NewRequest("HEAD", "/stream", nil), target)
+	if got := w.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("expected X-Cache HIT for HEAD, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/coverage?match="+target, nil))
+	var covs []Coverage
+	if err := json.NewDecoder(w.Body).Decode(&covs); err != nil {
+		t.Fatal(err)
+	}
+	if len(covs) != 1 {
+		t.Fatalf("expected the coverage of one file, got %+v", covs)
+	}
+	cov := covs[0]
+	size := int64(len(content))
+	if cov.Size != size || cov.Cached != size || cov.Percent != 100 || len(cov.Ranges) != 1 || cov.Ranges[0] != (ByteRange{0, size}) {
+		t.Errorf("expected the whole file to be cached, got %+v", cov)
+	}
+	if cov.LastAccess.IsZero() {
+		t.Error("expected the last access time")
+	}
+
+	if covs := h.Coverage(upstream.URL + "/unknown"); len(covs) != 0 {
+		t.Errorf("expected no coverage of an unregistered URL, got %+v", covs)
+	}
+}
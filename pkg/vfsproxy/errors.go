@@ -0,0 +1,64 @@
+package vfsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/vfs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// errorStatus maps an error from the VFS or the link backend to the
+// status code and message sent to the client. Messages never include
+// the underlying error so cache paths and upstream URLs are not leaked.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, vfs.ENOENT), errors.Is(err, link.ErrNotFound):
+		return http.StatusNotFound, "File not found"
+	case errors.Is(err, link.ErrForbidden):
+		return http.StatusForbidden, "Access to upstream file denied"
+	case errors.Is(err, link.ErrGone):
+		return http.StatusGone, "File no longer available upstream"
+	case errors.Is(err, link.ErrRateLimited):
+		return http.StatusTooManyRequests, "Upstream rate limit exceeded"
+	case errors.Is(err, link.ErrTimeout):
+		return http.StatusGatewayTimeout, "Upstream timed out"
+	case errors.Is(err, link.ErrUnknownSize), errors.Is(err, link.ErrUpstream):
+		return http.StatusBadGateway, "Upstream request failed"
+	}
+	return http.StatusInternalServerError, "Internal server error"
+}
+
+// WriteError replies to the request with the given status code and
+// message. Clients that accept JSON get a JSON object, everyone else a
+// plain text body as written by http.Error.
+func WriteError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Error(w, msg, code)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{msg, code})
+}
+
+// serveError logs err and replies with the matching client error.
+func serveError(w http.ResponseWriter, r *http.Request, remote string, err error) {
+	code, msg := errorStatus(err)
+	spanError(r.Context(), err)
+	if code == http.StatusNotFound {
+		fs.Infof(remote, "%s: File not found", r.RemoteAddr)
+	} else {
+		fs.Errorf(remote, "%s: %v", r.RemoteAddr, err)
+	}
+	WriteError(w, r, code, msg)
+}
@@ -0,0 +1,66 @@
+package vfsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rclone/rclone/vfs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{vfs.ENOENT, http.StatusNotFound},
+		{link.ErrNotFound, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", link.ErrForbidden), http.StatusForbidden},
+		{link.ErrGone, http.StatusGone},
+		{link.ErrRateLimited, http.StatusTooManyRequests},
+		{link.ErrTimeout, http.StatusGatewayTimeout},
+		{link.ErrUnknownSize, http.StatusBadGateway},
+		{link.ErrUpstream, http.StatusBadGateway},
+		{errors.New("open /var/cache/secret: permission denied"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		code, msg := errorStatus(tt.err)
+		if code != tt.want {
+			t.Errorf("%v: expected status %d, got %d", tt.err, tt.want, code)
+		}
+		if strings.Contains(msg, "/var/cache") {
+			t.Errorf("%v: message leaks internal path: %q", tt.err, msg)
+		}
+	}
+}
+
+func TestWriteErrorJSON(t *testing.T) {
+	r := httptest.NewRequest("GET", "/stream", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	WriteError(w, r, http.StatusGone, "File no longer available upstream")
+
+	if w.Code != http.StatusGone {
+		t.Errorf("expected status 410, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+	var body struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Status != http.StatusGone || body.Error != "File no longer available upstream" {
+		t.Errorf("unexpected body %+v", body)
+	}
+}
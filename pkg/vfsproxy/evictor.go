@@ -0,0 +1,163 @@
+package vfsproxy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/vfs/vfscache"
+	"github.com/tgdrive/rclone-vfs/pkg/evict"
+)
+
+// evictSyncInterval is how often an evictor forgets files the VFS cache
+// removed by itself, for example for being older than the max age.
+const evictSyncInterval = time.Minute
+
+// evictor enforces the max size of a disk cache with a policy from
+// package evict instead of rclone's oldest access first. rclone is
+// given no max size so the two don't compete.
+type evictor struct {
+	policy string
+	cache  *vfscache.Cache
+	kick   chan struct{}
+	stop   chan struct{}
+
+	mu    sync.Mutex
+	files *evict.Cache
+}
+
+func newEvictor(c *vfscache.Cache, policy string, maxSize int64) (*evictor, error) {
+	files, err := evict.New(policy, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	e := &evictor{
+		policy: policy,
+		cache:  c,
+		kick:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		files:  files,
+	}
+	e.load()
+	go e.run()
+	return e, nil
+}
+
+// load adds the files cached by previous runs, least recently accessed
+// first.
+func (e *evictor) load() {
+	type cached struct {
+		name  string
+		atime time.Time
+		size  int64
+	}
+	var files []cached
+	dataRoot, _ := cacheRoots(e.cache)
+	_ = filepath.Walk(dataRoot, func(osPath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dataRoot, osPath)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		info, err := readCacheInfo(e.cache, name)
+		if err != nil {
+			return nil
+		}
+		files = append(files, cached{name: name, atime: info.ATime, size: info.Rs.Size()})
+		return nil
+	})
+	slices.SortFunc(files, func(a, b cached) int { return a.atime.Compare(b.atime) })
+	for _, f := range files {
+		e.files.Add(f.name, f.size)
+	}
+	if len(files) > 0 {
+		e.wake()
+	}
+}
+
+// request records a GET of remote, a file of size bytes, and reports
+// whether it may enter the cache.
+func (e *evictor) request(remote string, size int64) bool {
+	e.mu.Lock()
+	admit := e.files.Request(remote, size)
+	over := e.files.Used() > e.files.MaxSize
+	e.mu.Unlock()
+	if over {
+		e.wake()
+	}
+	return admit
+}
+
+// add records remote as cached regardless of the admission filter.
+func (e *evictor) add(remote string, size int64) {
+	e.mu.Lock()
+	e.files.Add(remote, size)
+	e.mu.Unlock()
+	e.wake()
+}
+
+// used returns the size of the files the evictor tracks, counted in
+// full. Unlike the VFS cache statistics it is up to date between
+// cleanups.
+func (e *evictor) used() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.files.Used()
+}
+
+// wake makes the evictor check the cache size, for example because a
+// file it skipped as in use was closed.
+func (e *evictor) wake() {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (e *evictor) run() {
+	ticker := time.NewTicker(evictSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.kick:
+		case <-ticker.C:
+			e.sync()
+		}
+		e.evict()
+	}
+}
+
+// evict removes files chosen by the policy until the cache fits in its
+// max size. Files in use, which includes pinned files, are kept.
+func (e *evictor) evict() {
+	e.mu.Lock()
+	victims := e.files.Evict(e.cache.InUse)
+	e.mu.Unlock()
+	for _, name := range victims {
+		fs.Infof(name, "vfs cache: evicting by %s policy", e.policy)
+		e.cache.Remove(name)
+	}
+}
+
+// sync forgets files which are no longer in the cache.
+func (e *evictor) sync() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range e.files.Keys() {
+		if !isCached(e.cache, name) && !e.cache.InUse(name) {
+			e.files.Remove(name)
+		}
+	}
+}
+
+func (e *evictor) close() {
+	close(e.stop)
+}
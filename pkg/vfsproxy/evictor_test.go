@@ -0,0 +1,121 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cachedOnDisk reports whether h holds data of the file at url.
+func cachedOnDisk(h *Handler, url string) bool {
+	ns := h.namespace(context.Background())
+	remote := h.remotePath(ns, h.getFileHash(httptest.NewRequest("GET", "/stream", nil), "", url))
+	return isCached(diskCache(ns.vfs), remote)
+}
+
+func TestCachePolicyAdmission(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.CacheMaxSize = "1M"
+	opt.CachePolicy = "tinylfu"
+	h := newTestHandler(t, opt)
+
+	get := func() (*httptest.ResponseRecorder, *accessInfo) {
+		info := &accessInfo{}
+		r := httptest.NewRequest("GET", "/stream", nil)
+		r.Header.Set("Range", "bytes=100-199")
+		r = r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, info))
+		w := httptest.NewRecorder()
+		h.Serve(w, r, upstream.URL+"/video.mp4")
+		return w, info
+	}
+
+	// Requested once, the file is streamed without being cached
+	w, info := get()
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[100:200]) {
+		t.Fatalf("expected the range from the upstream, got %d %q", w.Code, w.Body)
+	}
+	if info.source != sourceBypass || info.size != int64(len(content)) {
+		t.Errorf("expected a bypass of the whole file size, got %+v", info)
+	}
+	if cachedOnDisk(h, upstream.URL+"/video.mp4") {
+		t.Error("expected a file requested once not to be cached")
+	}
+
+	// Requested again, it is admitted
+	w, info = get()
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[100:200]) {
+		t.Fatalf("expected the range from the cache, got %d %q", w.Code, w.Body)
+	}
+	if info.source == sourceBypass || !cachedOnDisk(h, upstream.URL+"/video.mp4") {
+		t.Errorf("expected a file requested twice to be cached, source %q", info.source)
+	}
+}
+
+func TestCachePolicyEvicts(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.CacheMaxSize = "25K"
+	opt.CachePolicy = "lfu"
+	h := newTestHandler(t, opt)
+
+	// The file requested last is being read when the cache gets full,
+	// so the least used of the others makes room for it
+	for _, name := range []string{"/popular", "/popular", "/once", "/new"} {
+		w := httptest.NewRecorder()
+		h.Serve(w, httptest.NewRequest("GET", "/stream", nil), upstream.URL+name)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", name, w.Code)
+		}
+		_, _ = io.Copy(io.Discard, w.Body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cachedOnDisk(h, upstream.URL+"/once") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the least used file to be evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cachedOnDisk(h, upstream.URL+"/popular") || !cachedOnDisk(h, upstream.URL+"/new") {
+		t.Error("expected the popular and the new file to stay cached")
+	}
+	if usage := h.Status().Cache; usage == nil || usage.Used != 2*int64(len(content)) || usage.Max != 25*1024 {
+		t.Errorf("expected two files of a 25K cache in use, got %+v", usage)
+	}
+}
+
+func TestCachePolicyOptions(t *testing.T) {
+	for name, opt := range map[string]Options{
+		"unknown":    {CachePolicy: "fifo", CacheMaxSize: "1G"},
+		"no max":     {CachePolicy: "lru", CacheMaxSize: "off"},
+		"cache mode": {CachePolicy: "lru", CacheMaxSize: "1G", CacheMode: "writes"},
+	} {
+		base := DefaultOptions()
+		base.FsName = "vfsproxy-" + t.Name()
+		base.CacheDir = t.TempDir()
+		base.CacheMode = "full"
+		base.CachePolicy, base.CacheMaxSize = opt.CachePolicy, opt.CacheMaxSize
+		if opt.CacheMode != "" {
+			base.CacheMode = opt.CacheMode
+		}
+		if h, err := NewHandler(base); err == nil {
+			h.Shutdown()
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
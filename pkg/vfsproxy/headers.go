@@ -0,0 +1,145 @@
+package vfsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// dispositioner is implemented by objects which know the upstream
+// Content-Disposition, such as link.Object.
+type dispositioner interface {
+	ContentDisposition() (dispType, filename string)
+}
+
+// setContentHeaders sets Content-Type and Content-Disposition for obj,
+// preferring what the upstream sent over guessing from the name.
+func (h *Handler) setContentHeaders(ctx context.Context, w http.ResponseWriter, r *http.Request, obj fs.Object, remote string) {
+	var dispType, filename string
+	if d, ok := obj.(dispositioner); ok {
+		dispType, filename = d.ContentDisposition()
+	}
+	if dispType == "" {
+		// With keep_filename the virtual path ends in the URL's file name
+		if name := path.Base(remote); name != h.namespace(ctx).hashOf(remote) {
+			dispType, filename = "inline", name
+		}
+	}
+	if h.filenameParam != "" {
+		if name := link.SanitizeFilename(r.URL.Query().Get(h.filenameParam)); name != "" {
+			filename = name
+			if dispType == "" {
+				dispType = "attachment"
+			}
+		}
+	}
+
+	mimeType := fs.MimeType(ctx, obj)
+	if mimeType == "application/octet-stream" && filename != "" {
+		if byExt := mime.TypeByExtension(path.Ext(filename)); byExt != "" {
+			mimeType = byExt
+		}
+	}
+	if mimeType == "application/octet-stream" && path.Ext(remote) == "" && path.Ext(filename) == "" {
+	} else {
+		w.Header().Set("Content-Type", mimeType)
+	}
+
+	if dispType != "" {
+		var params map[string]string
+		if filename != "" {
+			params = map[string]string{"filename": filename}
+		}
+		if v := mime.FormatMediaType(dispType, params); v != "" {
+			w.Header().Set("Content-Disposition", v)
+		}
+	}
+}
+
+// unpassedHeaders describe the framing or connection of an upstream
+// response rather than the file, or hold state of the upstream origin
+// such as cookies and credential challenges, so they are never
+// replayed. Proxy-* headers aren't either.
+var unpassedHeaders = map[string]bool{
+	"Accept-Ranges":     true,
+	"Alt-Svc":           true,
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Range":     true,
+	"Keep-Alive":        true,
+	"Set-Cookie":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Www-Authenticate":  true,
+}
+
+// unpassed reports whether the upstream header name is never replayed.
+func unpassed(name string) bool {
+	return unpassedHeaders[name] || strings.HasPrefix(name, "Proxy-")
+}
+
+// parsePassHeaders returns the upstream response header names to replay
+// from specs, canonicalised. A name ending in * is a prefix.
+func parsePassHeaders(specs []string) ([]string, error) {
+	var names []string
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		switch name := http.CanonicalHeaderKey(spec); {
+		case spec == "":
+		case spec == "*":
+			return nil, errors.New("header prefix * would pass every header")
+		case strings.HasSuffix(spec, "*"):
+			// Prefixes are matched regardless of case
+			names = append(names, spec)
+		case unpassed(name):
+			return nil, fmt.Errorf("header %s can't be passed through", name)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// passHeader reports whether the upstream header name is replayed.
+func (h *Handler) passHeader(name string) bool {
+	if unpassed(name) {
+		return false
+	}
+	for _, pass := range h.passHeaders {
+		if prefix, ok := strings.CutSuffix(pass, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if name == pass {
+			return true
+		}
+	}
+	return false
+}
+
+// setPassedHeaders replays the configured headers of the upstream
+// response the metadata of obj was read from.
+func (h *Handler) setPassedHeaders(w http.ResponseWriter, obj fs.Object) {
+	if len(h.passHeaders) == 0 {
+		return
+	}
+	o, ok := obj.(responseHeaderer)
+	if !ok {
+		return
+	}
+	for name, values := range o.ResponseHeader() {
+		if h.passHeader(name) {
+			w.Header()[name] = slices.Clone(values)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package vfsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Disposition", `attachment; filename="../movie.mp4"`)
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader("not really a movie"))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.FilenameParam = "filename"
+	h := newTestHandler(t, opt)
+
+	w := httptest.NewRecorder()
+	h.Serve(w, httptest.NewRequest("GET", "/stream", nil), upstream.URL+"/download")
+	if ct := w.Header().Get("Content-Type"); ct != "video/mp4" {
+		t.Errorf("expected upstream Content-Type, got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=movie.mp4` {
+		t.Errorf("expected sanitized upstream Content-Disposition, got %q", cd)
+	}
+
+	w = httptest.NewRecorder()
+	h.Serve(w, httptest.NewRequest("HEAD", "/stream?filename=Film.mkv", nil), upstream.URL+"/download")
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=Film.mkv` {
+		t.Errorf("expected overridden Content-Disposition, got %q", cd)
+	}
+}
+
+func TestKeepFilenameContentType(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader("<svg/>"))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.KeepFilename = true
+	h := newTestHandler(t, opt)
+
+	w := httptest.NewRecorder()
+	h.Serve(w, httptest.NewRequest("GET", "/stream", nil), upstream.URL+"/images/logo.svg")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("expected Content-Type from the file name, got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != "inline; filename=logo.svg" {
+		t.Errorf("expected inline disposition with file name, got %q", cd)
+	}
+}
+
+func TestPassHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Language", "de")
+		w.Header().Add("Link", `<https://example.com/subs.vtt>; rel="alternate"`)
+		w.Header().Set("X-Amz-Meta-Title", "Film")
+		w.Header().Set("X-Secret", "upstream only")
+		w.Header().Set("Set-Cookie", "session=upstream")
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader("data"))
+	}))
+	defer upstream.Close()
+
+	for _, spec := range []string{"content-length", "set-cookie", "WWW-Authenticate", "Proxy-Authenticate", "alt-svc", "*"} {
+		if _, err := parsePassHeaders([]string{spec}); err == nil {
+			t.Errorf("expected an error for %s", spec)
+		}
+	}
+
+	opt := DefaultOptions()
+	opt.PassHeaders = []string{"content-language", "Link", "x-amz-meta-*", "Content-Encoding*", "Set-*"}
+	h := newTestHandler(t, opt)
+	for _, method := range []string{"HEAD", "GET"} {
+		w := httptest.NewRecorder()
+		h.Serve(w, httptest.NewRequest(method, "/stream", nil), upstream.URL+"/film")
+		hdr := w.Header()
+		if hdr.Get("Content-Language") != "de" || hdr.Get("Link") == "" || hdr.Get("X-Amz-Meta-Title") != "Film" {
+			t.Errorf("%s: expected the configured upstream headers, got %v", method, hdr)
+		}
+		if hdr.Get("X-Secret") != "" || hdr.Get("Set-Cookie") != "" {
+			t.Errorf("%s: expected other upstream headers to be dropped", method)
+		}
+		if w.Body.Len() > 0 && w.Body.String() != "data" {
+			t.Errorf("%s: unexpected body %q", method, w.Body)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package vfsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/lib/diskusage"
+)
+
+// Drain marks the handler as shutting down so that readiness checks
+// fail and load balancers stop sending new requests.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// Ready returns nil if the handler can serve requests: the VFS is
+// initialised, the handler is not draining, the cache directory is
+// writable and has at least the configured minimum free space.
+func (h *Handler) Ready() error {
+	if h.VFS == nil {
+		return errors.New("vfs not initialised")
+	}
+	if h.draining.Load() {
+		return errors.New("shutting down")
+	}
+
+	dir := config.GetCacheDir()
+	if err := h.writable.check(dir); err != nil {
+		return errors.New("cache directory not writable")
+	}
+
+	if minFree := h.VFS.Opt.CacheMinFreeSpace; minFree > 0 {
+		info, err := diskusage.New(dir)
+		if err == nil && info.Available < uint64(minFree) {
+			return fmt.Errorf("cache directory has %v free, need %v", fs.SizeSuffix(info.Available), minFree)
+		}
+	}
+	return nil
+}
+
+// writableCheckInterval is how long a check that the cache directory is
+// writable is reused, so that frequent probes don't each create a file.
+const writableCheckInterval = 5 * time.Second
+
+// writableCheck remembers the result of the last write to the cache
+// directory.
+type writableCheck struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+// check returns nil if a file could be created in dir within the last
+// writableCheckInterval, trying again once that has passed.
+func (c *writableCheck) check(dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.at.IsZero() && time.Since(c.at) < writableCheckInterval {
+		return c.err
+	}
+	probe, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		fs.Errorf(nil, "Readiness check failed: %v", err)
+	} else {
+		_ = probe.Close()
+		_ = os.Remove(probe.Name())
+	}
+	c.at, c.err = time.Now(), err
+	return err
+}
+
+// Status describes the running handler.
+type Status struct {
+	Version   string            `json:"version"`
+	Uptime    string            `json:"uptime"`
+	Ready     bool              `json:"ready"`
+	Reason    string            `json:"reason,omitempty"`
+	CacheMode string            `json:"cache_mode"`
+	Cache     *Usage            `json:"cache,omitempty"`
+	Tenants   map[string]*Usage `json:"tenants,omitempty"`
+	Pinned    *Usage            `json:"pinned,omitempty"`
+	Archives  *Usage            `json:"archive_indexes,omitempty"`
+	Disk      *Usage            `json:"disk,omitempty"`
+	Warnings  []string          `json:"warnings,omitempty"`
+}
+
+// Usage reports used, maximum and available space in bytes.
+type Usage struct {
+	Files     int64  `json:"files,omitempty"`
+	Used      int64  `json:"used"`
+	Max       int64  `json:"max,omitempty"`
+	Available uint64 `json:"available,omitempty"`
+}
+
+// Status returns a snapshot of the handler's state. With tenants, Cache
+// sums the usage of every tenant and Tenants reports each of them.
+// Pinned counts the pinned files and their cached bytes, which are
+// included in the cache usage too. Archives counts the saved archive
+// indexes, which are not, as of their last sweep.
+func (h *Handler) Status() Status {
+	st := Status{
+		Version:   h.Version,
+		Uptime:    time.Since(h.started).Round(time.Second).String(),
+		CacheMode: h.VFS.Opt.CacheMode.String(),
+	}
+	if err := h.Ready(); err != nil {
+		st.Reason = err.Error()
+	} else {
+		st.Ready = true
+	}
+	unlimited := false
+	for _, ns := range h.namespaces() {
+		usage := cacheUsage(ns)
+		if usage == nil {
+			continue
+		}
+		if ns.name != "" {
+			if st.Tenants == nil {
+				st.Tenants = make(map[string]*Usage)
+			}
+			st.Tenants[ns.name] = usage
+		}
+		if st.Cache == nil {
+			st.Cache = &Usage{}
+		}
+		st.Cache.Files += usage.Files
+		st.Cache.Used += usage.Used
+		st.Cache.Max += usage.Max
+		unlimited = unlimited || usage.Max == 0
+	}
+	if st.Cache != nil && unlimited {
+		st.Cache.Max = 0
+	}
+	if pins := h.Pins(); len(pins) > 0 {
+		st.Pinned = &Usage{Files: int64(len(pins))}
+		for _, p := range pins {
+			st.Pinned.Used += p.Cached
+		}
+	}
+	if files := h.archives.files.Load(); files > 0 {
+		st.Archives = &Usage{Files: files, Used: h.archives.used.Load()}
+	}
+	for _, ns := range h.namespaces() {
+		if warning := h.pinWarning(ns); warning != "" {
+			st.Warnings = append(st.Warnings, warning)
+		}
+	}
+	if info, err := diskusage.New(config.GetCacheDir()); err == nil {
+		st.Disk = &Usage{Used: int64(info.Total - info.Free), Available: info.Available}
+	}
+	return st
+}
+
+// cacheUsage returns the usage of the disk cache of ns, or nil if
+// caching is off.
+func cacheUsage(ns *namespace) *Usage {
+	c := diskCache(ns.vfs)
+	if c == nil {
+		return nil
+	}
+	stats := c.Stats()
+	usage := &Usage{}
+	if files, ok := stats["files"].(int); ok {
+		usage.Files = int64(files)
+	}
+	if used, ok := stats["bytesUsed"].(int64); ok {
+		usage.Used = used
+	}
+	if ns.evictor != nil {
+		usage.Used = ns.evictor.used()
+	}
+	if ns.maxSize > 0 {
+		usage.Max = int64(ns.maxSize)
+	}
+	return usage
+}
+
+// ServeHealthz reports whether the process is alive.
+func (h *Handler) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// ServeReadyz replies 200 if Ready succeeds and 503 otherwise.
+func (h *Handler) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.Ready(); err != nil {
+		WriteError(w, r, http.StatusServiceUnavailable, "not ready: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// ServeStatus replies with the handler Status as JSON.
+func (h *Handler) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.Status())
+}
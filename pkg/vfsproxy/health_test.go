@@ -0,0 +1,58 @@
+package vfsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config"
+)
+
+func TestReadyz(t *testing.T) {
+	h := newTestHandler(t, DefaultOptions())
+
+	w := httptest.NewRecorder()
+	h.ServeReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected ready, got %d: %s", w.Code, w.Body)
+	}
+	// Probes in quick succession reuse the check of the cache directory
+	checked := h.writable.at
+	if err := h.Ready(); err != nil || h.writable.at != checked {
+		t.Errorf("expected the writable check to be reused, got %v", err)
+	}
+
+	h.Drain()
+	w = httptest.NewRecorder()
+	h.ServeReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while draining, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected healthz to stay ok while draining, got %d", w.Code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	h := newTestHandler(t, DefaultOptions())
+	h.Version = "v1.2.3"
+
+	w := httptest.NewRecorder()
+	h.ServeStatus(w, httptest.NewRequest("GET", "/status", nil))
+
+	if strings.Contains(w.Body.String(), config.GetCacheDir()) {
+		t.Errorf("expected the cache directory not to be disclosed, got %s", w.Body)
+	}
+	var st Status
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if st.Version != "v1.2.3" || st.CacheMode != "full" || !st.Ready || st.Cache == nil {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
@@ -0,0 +1,145 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+	"github.com/tgdrive/rclone-vfs/pkg/manifest"
+)
+
+// maxManifestSize is the size of the largest manifest rewritten. Larger
+// files are served as they are.
+const maxManifestSize = 16 << 20
+
+// streamURL is the default ManifestURLFunc. It returns a URL of the
+// stream endpoint r came in on, such as a tenant's /team-a/stream:
+// /stream/<base64> for files and /stream?url= for templates, which
+// players fill in themselves.
+func streamURL(r *http.Request, targetURL string, template bool) string {
+	prefix := r.URL.Path
+	if i := strings.Index(prefix, "/stream/"); i >= 0 {
+		prefix = prefix[:i+len("/stream")]
+	} else if !strings.HasSuffix(prefix, "/stream") {
+		prefix = "/stream"
+	}
+	if !template {
+		return prefix + "/" + base64.RawURLEncoding.EncodeToString([]byte(targetURL))
+	}
+	// Escape the text between the identifiers only
+	parts := strings.Split(targetURL, "$")
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = url.QueryEscape(parts[i])
+	}
+	return prefix + "?url=" + strings.Join(parts, "$")
+}
+
+// manifestKind returns the kind of manifest rewritten for obj at
+// remote, whose Content-Type is already set on w, or an empty string if
+// it is served as it is.
+func (h *Handler) manifestKind(w http.ResponseWriter, ns *namespace, obj fs.Object, remote string) string {
+	if !h.manifests || obj.Size() > maxManifestSize {
+		return ""
+	}
+	targetURL, _ := link.Load(ns.hashOf(remote))
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return manifest.Detect(w.Header().Get("Content-Type"), u.Path)
+}
+
+// serveManifest serves the manifest of kind read from in with its URIs
+// rewritten by h.ManifestURL. Live manifests are fresh for their
+// target duration, after which the next request fetches them again.
+func (h *Handler) serveManifest(w http.ResponseWriter, r *http.Request, ns *namespace, remote, kind string, modTime time.Time, in io.Reader) {
+	body, err := io.ReadAll(io.LimitReader(in, maxManifestSize+1))
+	if err != nil {
+		serveError(w, r, remote, err)
+		return
+	}
+	if len(body) > maxManifestSize {
+		WriteError(w, r, http.StatusBadGateway, "Manifest too large")
+		return
+	}
+	targetURL, _ := link.Load(ns.hashOf(remote))
+	base, _ := url.Parse(targetURL)
+	res, err := manifest.Rewrite(kind, body, base, func(target string, template bool) string {
+		return h.ManifestURL(r, target, template)
+	})
+	if err != nil {
+		// Players may still cope with what the upstream sent
+		fs.Errorf(remote, "Failed to rewrite manifest: %v", err)
+		res = &manifest.Result{Body: body}
+	}
+	if res.Live {
+		h.setLiveFreshness(w, ns, remote, res.Refresh)
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(res.Body))
+}
+
+// liveManifestKey returns the key of remote in ns in h.liveManifests.
+func liveManifestKey(ns *namespace, remote string) string {
+	return ns.name + "\x00" + remote
+}
+
+// setLiveFreshness records when the live manifest at remote, fresh for
+// refresh since it was fetched, expires, and limits the freshness
+// downstream caches give it to the time left.
+func (h *Handler) setLiveFreshness(w http.ResponseWriter, ns *namespace, remote string, refresh time.Duration) {
+	now := time.Now()
+	expires := now.Add(refresh)
+	if v, loaded := h.liveManifests.LoadOrStore(liveManifestKey(ns, remote), expires); loaded && v.(time.Time).After(now) {
+		expires = v.(time.Time)
+	} else if loaded {
+		h.liveManifests.Store(liveManifestKey(ns, remote), expires)
+	}
+
+	hdr := w.Header()
+	left := expires.Sub(now).Round(time.Second)
+	current := hdr.Get("Cache-Control")
+	if maxAge, ok := cacheControlMaxAge(current); ok && maxAge <= left || hasDirective(current, "no-cache") || hasDirective(current, "no-store") {
+		// Already no fresher than the manifest
+		return
+	}
+	if left <= 0 {
+		hdr.Set("Cache-Control", "no-cache")
+	} else {
+		hdr.Set("Cache-Control", "max-age="+strconv.FormatInt(int64(left/time.Second), 10))
+	}
+	// Age and Expires would count from the upstream response
+	hdr.Del("Age")
+	hdr.Del("Expires")
+}
+
+// manifestExpired returns true once the live manifest at remote in ns
+// is due to be fetched again, forgetting its expiry.
+func (h *Handler) manifestExpired(ns *namespace, remote string) bool {
+	if !h.manifests {
+		return false
+	}
+	key := liveManifestKey(ns, remote)
+	v, ok := h.liveManifests.Load(key)
+	if !ok || time.Now().Before(v.(time.Time)) {
+		return false
+	}
+	return h.liveManifests.CompareAndDelete(key, v)
+}
+
+// hasDirective returns true if the Cache-Control value has directive.
+func hasDirective(value, directive string) bool {
+	for _, d := range strings.Split(value, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package vfsproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamURL(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		target   string
+		template bool
+		want     string
+	}{
+		{"/stream", "https://a.example.com/seg.ts", false, "/stream/" + base64.RawURLEncoding.EncodeToString([]byte("https://a.example.com/seg.ts"))},
+		{"/team-a/stream/aHR0cHM6Ly9h", "https://a.example.com/b", false, "/team-a/stream/" + base64.RawURLEncoding.EncodeToString([]byte("https://a.example.com/b"))},
+		{"/stream", "https://a.example.com/$RepresentationID$/$Number%05d$.m4s?t=1", true, "/stream?url=https%3A%2F%2Fa.example.com%2F$RepresentationID$%2F$Number%05d$.m4s%3Ft%3D1"},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if got := streamURL(r, test.target, test.template); got != test.want {
+			t.Errorf("%s %s: expected %s, got %s", test.path, test.target, test.want, got)
+		}
+	}
+}
+
+func TestServeLiveManifest(t *testing.T) {
+	var mu sync.Mutex
+	sequence := 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seq := sequence
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1.0,\nseg" + strconv.Itoa(seq) + ".ts\n"))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.RewriteManifests = true
+	h := newTestHandler(t, opt)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.Serve(w, httptest.NewRequest("GET", "/stream/bWFuaWZlc3Q", nil), upstream.URL+"/live/index.m3u8")
+		return w
+	}
+	segment := func(n int) string {
+		return "/stream/" + base64.RawURLEncoding.EncodeToString([]byte(upstream.URL+"/live/seg"+strconv.Itoa(n)+".ts"))
+	}
+
+	w := get()
+	if !strings.HasSuffix(w.Body.String(), "\n"+segment(1)+"\n") {
+		t.Fatalf("expected the segment URI to be rewritten, got %q", w.Body)
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("expected the length of the rewritten manifest, got %s", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "max-age=1" {
+		t.Errorf("expected freshness limited to the target duration, got %q", got)
+	}
+
+	mu.Lock()
+	sequence = 2
+	mu.Unlock()
+	if w := get(); !strings.Contains(w.Body.String(), segment(1)) {
+		t.Errorf("expected the cached manifest within its target duration, got %q", w.Body)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if w := get(); !strings.Contains(w.Body.String(), segment(2)) {
+		t.Errorf("expected the manifest to be fetched again after its target duration, got %q", w.Body)
+	}
+}
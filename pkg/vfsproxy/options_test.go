@@ -69,7 +69,8 @@ func TestAddFlags(t *testing.T) {
 	}
 
 	// Test parsing a flag
-	err := fs.Parse([]string{"--fs-name", "overridden", "--shard-level", "3"})
+	err := fs.Parse([]string{"--fs-name", "overridden", "--shard-level", "3",
+		"--key-drop-query", "sig", "--key-drop-query", "expires"})
 	if err != nil {
 		t.Fatalf("failed to parse flags: %v", err)
 	}
@@ -80,4 +81,7 @@ func TestAddFlags(t *testing.T) {
 	if opt.ShardLevel != 3 {
 		t.Errorf("expected ShardLevel 3, got %d", opt.ShardLevel)
 	}
+	if len(opt.KeyDropQuery) != 2 || opt.KeyDropQuery[0] != "sig" || opt.KeyDropQuery[1] != "expires" {
+		t.Errorf("expected KeyDropQuery [sig expires], got %v", opt.KeyDropQuery)
+	}
 }
@@ -0,0 +1,130 @@
+package vfsproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// servePassThrough serves obj straight from the upstream, bypassing the
+// VFS cache. Ranges of files of known size are supported by opening
+// the object at the offset the response starts from.
+func servePassThrough(w http.ResponseWriter, r *http.Request, obj fs.Object, name string, modTime time.Time) {
+	if obj.Size() < 0 {
+		if r.Header.Get("Range") != "" {
+			WriteError(w, r, http.StatusRequestedRangeNotSatisfiable, "Can't use Range: on files of unknown length")
+			return
+		}
+		in, err := obj.Open(r.Context())
+		if err != nil {
+			serveError(w, r, name, err)
+			return
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		if n, err := io.Copy(w, in); err != nil {
+			fs.Errorf(obj, "Didn't finish writing GET request (wrote %d/unknown bytes): %v", n, err)
+		}
+		return
+	}
+	in := &objectReader{ctx: r.Context(), obj: obj, size: obj.Size()}
+	defer func() {
+		_ = in.Close()
+	}()
+	http.ServeContent(w, r, name, modTime, in)
+}
+
+// objectReader is an io.ReadSeeker over an object which opens it
+// lazily at the current offset, so seeking costs nothing until read.
+type objectReader struct {
+	ctx    context.Context
+	obj    fs.Object
+	size   int64
+	offset int64
+	in     io.ReadCloser
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.in == nil {
+		in, err := o.obj.Open(o.ctx, &fs.SeekOption{Offset: o.offset})
+		if err != nil {
+			return 0, err
+		}
+		o.in = in
+	}
+	n, err := o.in.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != o.offset {
+		_ = o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	if o.in == nil {
+		return nil
+	}
+	err := o.in.Close()
+	o.in = nil
+	return err
+}
+
+// maxSkip is how far past the end of the last read an objectReaderAt
+// reads on and drops the bytes in between rather than opening the
+// object again.
+const maxSkip = 256 << 10
+
+// objectReaderAt is an io.ReaderAt over an object which keeps reading
+// the same response while reads follow each other, as when scanning an
+// archive.
+type objectReaderAt struct {
+	mu sync.Mutex
+	r  objectReader
+}
+
+func (o *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if skip := off - o.r.offset; o.r.in != nil && skip > 0 && skip <= maxSkip {
+		if _, err := io.CopyN(io.Discard, &o.r, skip); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := o.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(&o.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *objectReaderAt) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.r.Close()
+}
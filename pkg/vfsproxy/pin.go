@@ -0,0 +1,506 @@
+package vfsproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/ranges"
+	"github.com/rclone/rclone/vfs"
+	"github.com/rclone/rclone/vfs/vfscommon"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// pinCheckInterval is how often pinned files are checked and fetched
+// again if the cache dropped some of their data.
+const pinCheckInterval = time.Minute
+
+// States of a pin.
+const (
+	PinPending  = "pending"  // waiting for a request to register the hash
+	PinFetching = "fetching" // downloading into the cache
+	PinPinned   = "pinned"   // fully cached and held open
+	PinFailed   = "failed"
+)
+
+var (
+	errPinCacheMode = errors.New("pinning needs cache mode full")
+	errPinNotFound  = errors.New("not pinned")
+)
+
+// PinInfo describes a pinned file.
+type PinInfo struct {
+	Target string `json:"target"`
+	Tenant string `json:"tenant,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	State  string `json:"state"`
+	Size   int64  `json:"size,omitempty"`
+	Cached int64  `json:"cached"`
+	Error  string `json:"error,omitempty"`
+}
+
+// pin is a file kept in the cache. The VFS cache never evicts files
+// which are open, so a pinned file is held open until it is unpinned.
+type pin struct {
+	info    PinInfo
+	ns      *namespace
+	remote  string     // path in the VFS of ns, once resolved
+	fromOpt bool       // configured in Options.Pins, not saved to the pin file
+	handle  vfs.Handle // nil until opened
+	removed bool
+}
+
+// pinSet holds the pins of a Handler.
+type pinSet struct {
+	mu   sync.Mutex
+	pins map[string]*pin // by pinKey
+	file string
+	stop chan struct{}
+}
+
+func pinKey(tenant, target string) string {
+	return tenant + " " + target
+}
+
+// isHash reports whether target is a link hash rather than a URL.
+func isHash(target string) bool {
+	return len(target) == 32 && strings.Trim(target, "0123456789abcdef") == ""
+}
+
+// parsePin parses a pin given as "[tenant ]target".
+func parsePin(line string) (tenant, target string, err error) {
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		target = fields[0]
+	case 2:
+		tenant, target = fields[0], fields[1]
+	default:
+		return "", "", fmt.Errorf("invalid pin %q: want [tenant ]url or hash", line)
+	}
+	return tenant, target, nil
+}
+
+// readPinFile returns the pins listed in the file at name, one per line.
+// Empty lines and lines starting with # are ignored. A missing file has
+// no pins.
+func readPinFile(name string) ([]string, error) {
+	in, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var lines []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// initPins pins the files from Options.Pins and the pin file.
+func (h *Handler) initPins(opt *Options) error {
+	h.pins.pins = make(map[string]*pin)
+	h.pins.file = opt.PinFile
+	if h.VFS.Opt.CacheMode < vfscommon.CacheModeFull {
+		if len(opt.Pins) > 0 || opt.PinFile != "" {
+			return errPinCacheMode
+		}
+		return nil
+	}
+	h.pins.stop = make(chan struct{})
+	go h.checkPins(h.pins.stop)
+	fromFile, err := readPinFile(opt.PinFile)
+	if err != nil {
+		return fmt.Errorf("failed to read pin file: %w", err)
+	}
+	for i, line := range append(slices.Clone(opt.Pins), fromFile...) {
+		tenant, target, err := parsePin(line)
+		if err != nil {
+			return err
+		}
+		if _, err := h.pin(tenant, target, i < len(opt.Pins)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pin keeps the file at target, a URL or link hash, in the cache of
+// tenant. It is downloaded in the background. A hash which is not
+// registered yet is fetched once a request for it arrives. Pins are
+// saved to the pin file if one is configured.
+func (h *Handler) Pin(tenant, target string) (PinInfo, error) {
+	if h.VFS.Opt.CacheMode < vfscommon.CacheModeFull {
+		return PinInfo{}, errPinCacheMode
+	}
+	info, err := h.pin(tenant, target, false)
+	if err != nil {
+		return info, err
+	}
+	return info, h.savePins()
+}
+
+func (h *Handler) pin(tenant, target string, fromOpt bool) (PinInfo, error) {
+	ns, err := h.tenantNamespace(tenant)
+	if err != nil {
+		return PinInfo{}, err
+	}
+	if !isHash(target) && !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return PinInfo{}, fmt.Errorf("invalid pin target %q: want a URL or link hash", target)
+	}
+	key := pinKey(ns.name, target)
+
+	h.pins.mu.Lock()
+	defer h.pins.mu.Unlock()
+	if p, ok := h.pins.pins[key]; ok {
+		p.fromOpt = p.fromOpt || fromOpt
+		if p.info.State == PinFailed {
+			// Pinning again retries
+			p.info.State = PinFetching
+			p.info.Error = ""
+			go h.fetchPin(p)
+		}
+		return p.info, nil
+	}
+	p := &pin{
+		info:    PinInfo{Target: target, Tenant: ns.name, State: PinFetching},
+		ns:      ns,
+		fromOpt: fromOpt,
+	}
+	h.pins.pins[key] = p
+	if isHash(target) {
+		p.info.Hash = target
+		if _, ok := link.Load(target); !ok {
+			p.info.State = PinPending
+			return p.info, nil
+		}
+	}
+	go h.fetchPin(p)
+	return p.info, nil
+}
+
+// tenantNamespace returns the namespace of the named tenant, or the
+// default one if tenant is empty.
+func (h *Handler) tenantNamespace(tenant string) (*namespace, error) {
+	if h.tenantFrom == "" {
+		if tenant != "" {
+			return nil, errUnknownTenant
+		}
+		return h.namespace(context.Background()), nil
+	}
+	if tenant == "" {
+		tenant = h.tenantDefault
+	}
+	if tenant == "" {
+		return nil, errTenantRequired
+	}
+	ns, ok := h.tenants[tenant]
+	if !ok {
+		return nil, errUnknownTenant
+	}
+	return ns, nil
+}
+
+// Unpin releases the pin of target in tenant so that the file can be
+// evicted again.
+func (h *Handler) Unpin(tenant, target string) error {
+	ns, err := h.tenantNamespace(tenant)
+	if err != nil {
+		return err
+	}
+	key := pinKey(ns.name, target)
+	h.pins.mu.Lock()
+	p, ok := h.pins.pins[key]
+	if ok {
+		delete(h.pins.pins, key)
+		p.removed = true
+		if p.handle != nil {
+			_ = p.handle.Close()
+			p.handle = nil
+		}
+	}
+	h.pins.mu.Unlock()
+	if !ok {
+		return errPinNotFound
+	}
+	if ns.evictor != nil {
+		ns.evictor.wake()
+	}
+	return h.savePins()
+}
+
+// Pins returns the pinned files sorted by tenant and target.
+func (h *Handler) Pins() []PinInfo {
+	h.pins.mu.Lock()
+	pins := make([]*pin, 0, len(h.pins.pins))
+	for _, p := range h.pins.pins {
+		pins = append(pins, p)
+	}
+	h.pins.mu.Unlock()
+
+	infos := make([]PinInfo, 0, len(pins))
+	for _, p := range pins {
+		h.pins.mu.Lock()
+		info, remote := p.info, p.remote
+		h.pins.mu.Unlock()
+		info.Cached = pinCached(p.ns, remote, info.Size)
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b PinInfo) int {
+		return strings.Compare(pinKey(a.Tenant, a.Target), pinKey(b.Tenant, b.Target))
+	})
+	return infos
+}
+
+// pinCached returns how many bytes of the pinned file of size at remote
+// are in the cache of ns.
+func pinCached(ns *namespace, remote string, size int64) int64 {
+	c := diskCache(ns.vfs)
+	if c == nil || remote == "" || size <= 0 || !isCached(c, remote) {
+		return 0
+	}
+	rng := ranges.Range{Pos: 0, Size: size}
+	item := c.Item(remote)
+	if item.HasRange(rng) {
+		return size
+	}
+	return size - item.FindMissing(rng).Size
+}
+
+// activatePin starts fetching a pin waiting for fileHash to be
+// registered in ns.
+func (h *Handler) activatePin(ns *namespace, fileHash string) {
+	h.pins.mu.Lock()
+	defer h.pins.mu.Unlock()
+	p, ok := h.pins.pins[pinKey(ns.name, fileHash)]
+	if !ok || p.info.State != PinPending {
+		return
+	}
+	p.info.State = PinFetching
+	go h.fetchPin(p)
+}
+
+// fetchPin downloads the pinned file into the cache and keeps it open.
+func (h *Handler) fetchPin(p *pin) {
+	ctx := context.Background()
+	ns := p.ns
+
+	h.pins.mu.Lock()
+	target, fileHash := p.info.Target, p.info.Hash
+	h.pins.mu.Unlock()
+	if fileHash == "" {
+		r, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			h.pinFailed(p, err)
+			return
+		}
+		fileHash = h.getFileHash(r, ns.name, target)
+		ns.register(ctx, fileHash, target, nil)
+	}
+	if ns.linkFs != nil {
+		fileHash = ns.linkFs.Canonical(ctx, fileHash)
+	}
+	remote := h.remotePath(ns, fileHash)
+
+	node, err := ns.stat(remote)
+	var handle vfs.Handle
+	if err == nil {
+		handle, err = node.Open(os.O_RDONLY)
+	}
+	if err != nil {
+		if upstreamErr := link.LastError(fileHash); upstreamErr != nil {
+			err = upstreamErr
+		}
+		h.pinFailed(p, err)
+		return
+	}
+	h.pins.mu.Lock()
+	if p.removed {
+		h.pins.mu.Unlock()
+		_ = handle.Close()
+		return
+	}
+	p.handle = handle
+	p.remote = remote
+	p.info.Hash = fileHash
+	h.pins.mu.Unlock()
+
+	size, err := prefetch(handle)
+	if err != nil {
+		h.pinFailed(p, err)
+		return
+	}
+	h.pins.mu.Lock()
+	p.info.State = PinPinned
+	p.info.Size = size
+	p.info.Error = ""
+	h.pins.mu.Unlock()
+	if ns.evictor != nil {
+		// Pins bypass the admission filter and count towards the
+		// max size, but are never evicted as their handle is open
+		ns.evictor.add(remote, size)
+	}
+	fs.Infof(remote, "Pinned %s (%v)", redactURL(target), fs.SizeSuffix(size))
+	if warning := h.pinWarning(ns); warning != "" {
+		fs.Logf(nil, "%s", warning)
+	}
+}
+
+// prefetch reads the whole file through handle so that the cache
+// downloads any data it is missing.
+func prefetch(handle vfs.Handle) (int64, error) {
+	fi, err := handle.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	n, err := io.Copy(io.Discard, io.NewSectionReader(handle, 0, size))
+	if err != nil {
+		return n, err
+	}
+	return size, nil
+}
+
+func (h *Handler) pinFailed(p *pin, err error) {
+	h.pins.mu.Lock()
+	defer h.pins.mu.Unlock()
+	if p.removed {
+		return
+	}
+	fs.Errorf(nil, "Failed to pin %s: %v", redactURL(p.info.Target), err)
+	p.info.State = PinFailed
+	p.info.Error = err.Error()
+	if p.handle != nil {
+		_ = p.handle.Close()
+		p.handle = nil
+	}
+}
+
+// pinWarning returns a warning if the pinned files of ns alone are
+// larger than its cache may grow.
+func (h *Handler) pinWarning(ns *namespace) string {
+	maxSize := ns.maxSize
+	if maxSize <= 0 {
+		return ""
+	}
+	var pinned int64
+	h.pins.mu.Lock()
+	for _, p := range h.pins.pins {
+		if p.ns.name == ns.name {
+			pinned += p.info.Size
+		}
+	}
+	h.pins.mu.Unlock()
+	if pinned <= int64(maxSize) {
+		return ""
+	}
+	what := "the cache"
+	if ns.name != "" {
+		what = "the cache of tenant " + ns.name
+	}
+	return fmt.Sprintf("pinned files use %v, more than the %v max size of %s", fs.SizeSuffix(pinned), maxSize, what)
+}
+
+// checkPins fetches the data of pinned files again if the cache dropped
+// it, which it does to files in use when it can't get below its max
+// size otherwise.
+func (h *Handler) checkPins(stop <-chan struct{}) {
+	ticker := time.NewTicker(pinCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		h.pins.mu.Lock()
+		var pinned []*pin
+		for _, p := range h.pins.pins {
+			if p.info.State == PinPinned {
+				pinned = append(pinned, p)
+			}
+		}
+		h.pins.mu.Unlock()
+		for _, p := range pinned {
+			h.pins.mu.Lock()
+			info, remote, handle := p.info, p.remote, p.handle
+			h.pins.mu.Unlock()
+			if handle == nil || pinCached(p.ns, remote, info.Size) == info.Size {
+				continue
+			}
+			fs.Logf(nil, "Pinned %s was partly evicted, fetching it again", redactURL(info.Target))
+			if _, err := prefetch(handle); err != nil {
+				fs.Errorf(nil, "Failed to fetch pinned %s again: %v", redactURL(info.Target), err)
+			}
+		}
+	}
+}
+
+// savePins writes the pins not configured in Options to the pin file.
+func (h *Handler) savePins() error {
+	if h.pins.file == "" {
+		return nil
+	}
+	h.pins.mu.Lock()
+	var lines []string
+	for _, p := range h.pins.pins {
+		if p.fromOpt {
+			continue
+		}
+		line := p.info.Target
+		if p.info.Tenant != "" {
+			line = p.info.Tenant + " " + line
+		}
+		lines = append(lines, line)
+	}
+	h.pins.mu.Unlock()
+	slices.Sort(lines)
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.pins.file), ".pins-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	content := "# Files kept in the cache, as [tenant ]url or hash\n" + strings.Join(lines, "\n") + "\n"
+	if _, err := tmp.WriteString(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.pins.file)
+}
+
+// closePins releases every pin, for shutdown.
+func (h *Handler) closePins() {
+	h.pins.mu.Lock()
+	defer h.pins.mu.Unlock()
+	if h.pins.stop != nil {
+		close(h.pins.stop)
+		h.pins.stop = nil
+	}
+	for _, p := range h.pins.pins {
+		if p.handle != nil {
+			_ = p.handle.Close()
+			p.handle = nil
+		}
+	}
+}
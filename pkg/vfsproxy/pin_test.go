@@ -0,0 +1,114 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitPinned waits until every pin of h has left the fetching state.
+func waitPinned(t *testing.T, h *Handler) []PinInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pins := h.Pins()
+		done := true
+		for _, p := range pins {
+			done = done && p.State != PinFetching
+		}
+		if done {
+			return pins
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pins still fetching: %+v", pins)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPin(t *testing.T) {
+	content := bytes.Repeat([]byte("pinned"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	pinFile := filepath.Join(t.TempDir(), "pins")
+	opt := DefaultOptions()
+	opt.CacheMaxSize = "1K"
+	opt.Pins = []string{upstream.URL + "/intro.mp4"}
+	opt.PinFile = pinFile
+	h := newTestHandler(t, opt)
+
+	pins := waitPinned(t, h)
+	if len(pins) != 1 || pins[0].State != PinPinned || pins[0].Cached != int64(len(content)) {
+		t.Fatalf("expected intro to be fully cached, got %+v", pins)
+	}
+
+	st := h.Status()
+	if st.Pinned == nil || st.Pinned.Files != 1 || st.Pinned.Used != int64(len(content)) {
+		t.Errorf("unexpected pinned usage %+v", st.Pinned)
+	}
+	if len(st.Warnings) != 1 || !strings.Contains(st.Warnings[0], "more than") {
+		t.Errorf("expected a warning as pins exceed the max size, got %v", st.Warnings)
+	}
+
+	// Pins made through the admin API are saved to the pin file
+	admin := h.AdminHandler()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/pins", strings.NewReader(`{"target":"`+upstream.URL+`/setup.exe"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected pin to be accepted, got %d: %s", w.Code, w.Body)
+	}
+	waitPinned(t, h)
+	saved, err := readPinFile(pinFile)
+	if err != nil || len(saved) != 1 || saved[0] != upstream.URL+"/setup.exe" {
+		t.Errorf("expected pin file to list the admin pin only, got %v, %v", saved, err)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/pins", strings.NewReader(`{"target":"`+upstream.URL+`/setup.exe"}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected unpin to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if pins := h.Pins(); len(pins) != 1 {
+		t.Errorf("expected one pin left, got %+v", pins)
+	}
+	if data, _ := os.ReadFile(pinFile); strings.Contains(string(data), "setup.exe") {
+		t.Errorf("expected unpinned file to be removed from the pin file, got %q", data)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/pins", strings.NewReader(`{"target":"`+upstream.URL+`/setup.exe"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a file not pinned, got %d", w.Code)
+	}
+}
+
+func TestPinHashWaitsForRegistration(t *testing.T) {
+	content := []byte("registered later")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+	r := httptest.NewRequest("GET", "/stream", nil)
+	fileHash := h.getFileHash(r, "", upstream.URL+"/later.bin")
+
+	info, err := h.Pin("", fileHash)
+	if err != nil || info.State != PinPending {
+		t.Fatalf("expected pending pin, got %+v, %v", info, err)
+	}
+
+	h.Serve(httptest.NewRecorder(), r, upstream.URL+"/later.bin")
+	pins := waitPinned(t, h)
+	if len(pins) != 1 || pins[0].State != PinPinned || pins[0].Cached != int64(len(content)) {
+		t.Errorf("expected pin to be fetched once registered, got %+v", pins)
+	}
+}
@@ -0,0 +1,464 @@
+package vfsproxy
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tgdrive/rclone-vfs/pkg/gzseek"
+)
+
+// maxArchiveIndexes is the number of tar indexes kept in memory.
+const maxArchiveIndexes = 64
+
+// tarIndex lists the members of a tar archive with the offsets of their
+// data, so they can be read without scanning the archive again.
+type tarIndex struct {
+	Fingerprint string // of the archive the index was built from
+	Members     []tarMember
+	Gzip        *gzseek.Index // seek points of a gzip compressed archive
+
+	cached bool // built from the archive in the cache, and removed with it
+}
+
+// tarMember is a member of a tar archive.
+type tarMember struct {
+	ArchiveMember
+	Offset int64 // of the data in the uncompressed archive
+	Type   byte
+	Sparse bool
+}
+
+// archiveIndexes holds the tar indexes in use, by the path they are
+// saved at, and removes saved indexes no longer needed.
+type archiveIndexes struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*indexEntry
+	stop    chan struct{}
+
+	files atomic.Int64 // number of saved indexes as of the last sweep
+	used  atomic.Int64 // their size in bytes
+}
+
+// indexEntry is the index of one archive. mu is held while it is read
+// or built so concurrent requests scan the archive once.
+type indexEntry struct {
+	mu      sync.Mutex
+	index   *tarIndex
+	touched time.Time // when the modification time of the saved index was last set
+}
+
+// entry returns the entry of the index saved at name.
+func (x *archiveIndexes) entry(name string) *indexEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[name]; ok {
+		return e
+	}
+	if x.entries == nil {
+		x.entries = map[string]*indexEntry{}
+	}
+	if len(x.entries) >= maxArchiveIndexes {
+		for other := range x.entries {
+			// They can be read from disk again
+			delete(x.entries, other)
+			break
+		}
+	}
+	e := &indexEntry{}
+	x.entries[name] = e
+	return e
+}
+
+// path returns the path the index of the archive at remote in ns is
+// saved at.
+func (x *archiveIndexes) path(ns *namespace, remote string) string {
+	return filepath.Join(x.dir, ns.name, filepath.FromSlash(remote)) + ".idx"
+}
+
+// touch marks the saved index of e as used. Indexes record use in their
+// modification time, at most once a minute.
+func (e *indexEntry) touch(name string) {
+	if now := time.Now(); now.Sub(e.touched) > time.Minute {
+		e.touched = now
+		_ = os.Chtimes(name, now, now)
+	}
+}
+
+// start removes indexes no longer needed by the namespaces of h every
+// evictSyncInterval until close is called.
+func (x *archiveIndexes) start(h *Handler) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(evictSyncInterval)
+		defer ticker.Stop()
+		for {
+			x.sweep(h.namespaces())
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(x.stop)
+}
+
+func (x *archiveIndexes) close() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.stop != nil {
+		close(x.stop)
+		x.stop = nil
+	}
+}
+
+// sweep removes the saved indexes of archives which left the cache of
+// their namespace, and those of archives read past the cache once they
+// haven't been used for the max age of the cache, then records the
+// number and size of the indexes left.
+func (x *archiveIndexes) sweep(nss []*namespace) {
+	var files, used int64
+	for _, ns := range nss {
+		c := diskCache(ns.vfs)
+		if c == nil {
+			continue
+		}
+		root := filepath.Join(x.dir, ns.name)
+		_ = filepath.Walk(root, func(osPath string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if fi.IsDir() {
+				if osPath != root && ns.name == "" && filepath.Dir(osPath) == root && slices.ContainsFunc(nss, func(other *namespace) bool { return other.name == fi.Name() }) {
+					// Swept with the tenant
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root, osPath)
+			if err != nil || !strings.HasSuffix(rel, ".idx") {
+				return nil
+			}
+			remote := filepath.ToSlash(strings.TrimSuffix(rel, ".idx"))
+			if !isCached(c, remote) && (x.cached(osPath) || time.Since(fi.ModTime()) > time.Duration(ns.vfs.Opt.CacheMaxAge)) {
+				fs.Debugf(remote, "Removing archive index")
+				x.remove(osPath)
+				return nil
+			}
+			files++
+			used += fi.Size()
+			return nil
+		})
+	}
+	x.files.Store(files)
+	x.used.Store(used)
+}
+
+// cached reports whether the index saved at name was built from an
+// archive in the cache.
+func (x *archiveIndexes) cached(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var flag [1]byte
+	_, err = io.ReadFull(f, flag[:])
+	return err == nil && flag[0] == 1
+}
+
+// remove deletes the index saved at name.
+func (x *archiveIndexes) remove(name string) {
+	x.mu.Lock()
+	delete(x.entries, name)
+	x.mu.Unlock()
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		fs.Errorf(nil, "Failed to remove archive index: %v", err)
+	}
+}
+
+// archiveFingerprint identifies the version of the archive obj by its
+// size and the upstream's ETag and Last-Modified, if it sent them.
+// Unlike fs.Fingerprint it leaves out the modification time, which is
+// the time of the metadata fetch if the upstream sent no Last-Modified.
+func archiveFingerprint(obj fs.Object) string {
+	fingerprint := strconv.FormatInt(obj.Size(), 10)
+	if o, ok := obj.(responseHeaderer); ok {
+		header := o.ResponseHeader()
+		for _, name := range []string{"ETag", "Last-Modified"} {
+			fingerprint += "," + header.Get(name)
+		}
+	}
+	return fingerprint
+}
+
+// tarIndexOf returns the index of the tar archive a, building it on
+// first use or after the archive changed.
+func (h *Handler) tarIndexOf(a *archive) (*tarIndex, error) {
+	name := h.archives.path(a.ns, a.remote)
+	e := h.archives.entry(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fingerprint := archiveFingerprint(a.obj)
+	if e.index != nil && e.index.Fingerprint == fingerprint {
+		e.touch(name)
+		return e.index, nil
+	}
+	if index, err := readTarIndex(name); err == nil && index.Fingerprint == fingerprint {
+		e.index = index
+		e.touch(name)
+		return index, nil
+	}
+	index, err := buildTarIndex(a)
+	if err != nil {
+		return nil, err
+	}
+	index.Fingerprint = fingerprint
+	index.cached = a.cached
+	if err := writeTarIndex(name, index); err != nil {
+		fs.Errorf(a.remote, "Failed to save archive index: %v", err)
+	}
+	e.index = index
+	e.touched = time.Now()
+	return index, nil
+}
+
+// buildTarIndex reads the headers of the tar archive a. Members of an
+// uncompressed archive are skipped by seeking, a compressed archive is
+// decompressed in full to record its seek points.
+func buildTarIndex(a *archive) (*tarIndex, error) {
+	index := &tarIndex{}
+	sr := io.NewSectionReader(a.in, 0, a.file.Size())
+	var magic [2]byte
+	_, _ = a.in.ReadAt(magic[:], 0)
+
+	var src io.Reader = sr
+	offset := func() int64 {
+		off, _ := sr.Seek(0, io.SeekCurrent)
+		return off
+	}
+	var indexer *gzseek.Indexer
+	if magic == [2]byte{0x1f, 0x8b} {
+		indexer = gzseek.NewIndexer(sr, gzseek.DefaultSpan)
+		counter := &countingReader{r: indexer}
+		src, offset = counter, func() int64 { return counter.n }
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sparse := hdr.Typeflag == tar.TypeGNUSparse
+		for key := range hdr.PAXRecords {
+			sparse = sparse || strings.HasPrefix(key, "GNU.sparse.")
+		}
+		index.Members = append(index.Members, tarMember{
+			ArchiveMember: ArchiveMember{
+				Name:     strings.TrimPrefix(path.Clean("/"+hdr.Name), "/"),
+				Size:     hdr.Size,
+				Modified: hdr.ModTime,
+				Dir:      hdr.Typeflag == tar.TypeDir,
+			},
+			Offset: offset(),
+			Type:   hdr.Typeflag,
+			Sparse: sparse,
+		})
+	}
+	if indexer != nil {
+		// The index covers the padding after the end of the archive
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			return nil, err
+		}
+		index.Gzip = indexer.Index()
+	}
+	return index, nil
+}
+
+// readTarIndex reads the index saved at name. The file starts with a
+// byte which is 1 if the index is of an archive in the cache.
+func readTarIndex(name string) (*tarIndex, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	in := bufio.NewReader(f)
+	flag, err := in.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	index := &tarIndex{cached: flag == 1}
+	if err := gob.NewDecoder(in).Decode(index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// writeTarIndex saves index at name.
+func writeTarIndex(name string, index *tarIndex) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var flag byte
+	if index.cached {
+		flag = 1
+	}
+	out := bufio.NewWriter(f)
+	_ = out.WriteByte(flag)
+	err = gob.NewEncoder(out).Encode(index)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// serveTar serves member of the tar archive a, or lists its members if
+// member is empty. The first request reads the whole archive if it is
+// compressed, and its headers otherwise. Members support Range
+// requests either way.
+func (h *Handler) serveTar(w http.ResponseWriter, r *http.Request, a *archive, member string) {
+	index, err := h.tarIndexOf(a)
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, gzseek.ErrHeader) {
+		WriteError(w, r, http.StatusBadGateway, "Not a tar archive")
+		return
+	}
+	if err != nil {
+		serveError(w, r, a.remote, err)
+		return
+	}
+
+	if member == "" {
+		members := make([]ArchiveMember, 0, len(index.Members))
+		for _, m := range index.Members {
+			members = append(members, m.ArchiveMember)
+		}
+		writeJSON(w, members)
+		return
+	}
+
+	var m *tarMember
+	for i := range index.Members {
+		// Later members replace earlier ones of the same name
+		if index.Members[i].Name == member {
+			m = &index.Members[i]
+		}
+	}
+	switch {
+	case m == nil || m.Dir:
+		WriteError(w, r, http.StatusNotFound, "Member not found")
+		return
+	case m.Type != tar.TypeReg && m.Type != tar.TypeGNUSparse:
+		WriteError(w, r, http.StatusNotFound, "Not a regular file")
+		return
+	case m.Sparse:
+		WriteError(w, r, http.StatusNotImplemented, "Sparse members are not supported")
+		return
+	}
+
+	setMemberHeaders(w, m.Name)
+	if index.Gzip == nil {
+		http.ServeContent(w, r, m.Name, m.Modified, io.NewSectionReader(a.in, m.Offset, m.Size))
+		return
+	}
+	in := &lazyReader{size: m.Size, open: func(offset int64) (io.Reader, error) {
+		return index.Gzip.NewReader(a.in, m.Offset+offset)
+	}}
+	http.ServeContent(w, r, m.Name, m.Modified, in)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// lazyReader is an io.ReadSeeker of size bytes which calls open to read
+// from the current offset, so seeking costs nothing until read.
+type lazyReader struct {
+	open   func(offset int64) (io.Reader, error)
+	size   int64
+	offset int64
+	r      io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.offset >= l.size {
+		return 0, io.EOF
+	}
+	if l.r == nil {
+		r, err := l.open(l.offset)
+		if err != nil {
+			return 0, err
+		}
+		l.r = r
+	}
+	n, err := l.r.Read(p[:min(int64(len(p)), l.size-l.offset)])
+	l.offset += int64(n)
+	if err == io.EOF && l.offset < l.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (l *lazyReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += l.offset
+	case io.SeekEnd:
+		offset += l.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != l.offset {
+		l.r = nil
+		l.offset = offset
+	}
+	return offset, nil
+}
@@ -0,0 +1,231 @@
+package vfsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/vfs"
+	"github.com/rclone/rclone/vfs/vfscommon"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+	"github.com/tgdrive/rclone-vfs/pkg/auth"
+)
+
+var (
+	errTenantRequired = errors.New("tenant required")
+	errUnknownTenant  = errors.New("unknown tenant")
+)
+
+// namespace is the part of the cache requests are served from. Each
+// tenant has its own, backed by a link file system rooted at the
+// tenant's directory and a VFS with the tenant's cache limits.
+type namespace struct {
+	name    string
+	vfs     *vfs.VFS
+	linkFs  *link.Fs
+	maxSize fs.SizeSuffix // max size of the cache, enforced by evictor if set
+	evictor *evictor
+}
+
+type namespaceKey struct{}
+
+// tenantSpec is a tenant parsed from Options.Tenants. Empty limits are
+// taken from the global options.
+type tenantSpec struct {
+	name    string
+	maxSize string
+	maxAge  string
+}
+
+// parseTenant parses a tenant given as name[:max-size[:max-age]].
+func parseTenant(spec string) (tenantSpec, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return tenantSpec{}, fmt.Errorf("invalid tenant %q: want name[:max-size[:max-age]]", spec)
+	}
+	parts = append(parts, "", "")
+	t := tenantSpec{name: strings.TrimSpace(parts[0]), maxSize: parts[1], maxAge: parts[2]}
+	if err := checkTenantName(t.name); err != nil {
+		return tenantSpec{}, err
+	}
+	return t, nil
+}
+
+// checkTenantName rejects names which can't be used as a directory of
+// the link file system or could be mistaken for a shard directory.
+func checkTenantName(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid tenant name %q", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("invalid tenant name %q: must not contain slashes", name)
+	case strings.Trim(name, "0123456789abcdefABCDEF") == "":
+		return fmt.Errorf("invalid tenant name %q: must not be hexadecimal", name)
+	}
+	return nil
+}
+
+// tenantSource returns how the tenant of a request is derived from the
+// tenant_from option: "identity", "header:<name>" or "path".
+func tenantSource(from string) (kind, header string, err error) {
+	kind, header, _ = strings.Cut(from, ":")
+	switch {
+	case kind == "identity" || kind == "path":
+		if header != "" {
+			return "", "", fmt.Errorf("invalid tenant source %q", from)
+		}
+	case kind == "header":
+		if header == "" {
+			return "", "", errors.New("tenant source header needs a header name, as header:X-Tenant")
+		}
+		header = http.CanonicalHeaderKey(header)
+	default:
+		return "", "", fmt.Errorf("invalid tenant source %q: want identity, header:<name> or path", from)
+	}
+	return kind, header, nil
+}
+
+// tenantOf returns the name of the tenant r belongs to, or an empty
+// string if it names none.
+func (h *Handler) tenantOf(r *http.Request) string {
+	switch h.tenantFrom {
+	case "identity":
+		if id := auth.FromContext(r.Context()); id != nil {
+			return id.Name
+		}
+	case "header":
+		return strings.TrimSpace(r.Header.Get(h.tenantHeader))
+	case "path":
+		return r.PathValue("tenant")
+	}
+	return ""
+}
+
+// namespaceFor returns the namespace serving r.
+func (h *Handler) namespaceFor(r *http.Request) (*namespace, error) {
+	if h.tenantFrom == "" {
+		return h.namespace(r.Context()), nil
+	}
+	name := h.tenantOf(r)
+	if name == "" {
+		name = h.tenantDefault
+	}
+	if name == "" {
+		return nil, errTenantRequired
+	}
+	ns, ok := h.tenants[name]
+	if !ok {
+		return nil, errUnknownTenant
+	}
+	return ns, nil
+}
+
+// newNamespace returns a namespace serving f with a VFS using opt. With
+// a cache policy rclone's own max size is lifted and the policy
+// enforces it instead.
+func (h *Handler) newNamespace(name string, f fs.Fs, linkFs *link.Fs, opt vfscommon.Options) (*namespace, error) {
+	ns := &namespace{name: name, linkFs: linkFs, maxSize: opt.CacheMaxSize}
+	if h.cachePolicy == "" {
+		ns.vfs = vfs.New(f, &opt)
+		return ns, nil
+	}
+	if ns.maxSize <= 0 {
+		return nil, errors.New("a cache policy needs a max size")
+	}
+	opt.CacheMaxSize = -1
+	ns.vfs = vfs.New(f, &opt)
+	var err error
+	ns.evictor, err = newEvictor(diskCache(ns.vfs), h.cachePolicy, int64(ns.maxSize))
+	if err != nil {
+		ns.vfs.Shutdown()
+		return nil, err
+	}
+	return ns, nil
+}
+
+// namespace returns the namespace stored in ctx by Serve, or the
+// default one for requests passed to ServeFile directly.
+func (h *Handler) namespace(ctx context.Context) *namespace {
+	if ns, ok := ctx.Value(namespaceKey{}).(*namespace); ok {
+		return ns
+	}
+	if h.defaultNS != nil && h.defaultNS.vfs == h.VFS {
+		return h.defaultNS
+	}
+	// h.VFS was replaced by a library user
+	ns := &namespace{vfs: h.VFS, linkFs: h.linkFs}
+	if h.VFS != nil {
+		ns.maxSize = h.VFS.Opt.CacheMaxSize
+	}
+	return ns
+}
+
+// namespaces returns every namespace of h, tenants in the order they
+// were configured.
+func (h *Handler) namespaces() []*namespace {
+	if len(h.tenants) == 0 {
+		return []*namespace{h.namespace(context.Background())}
+	}
+	nss := make([]*namespace, 0, len(h.tenants))
+	for _, name := range h.tenantNames {
+		nss = append(nss, h.tenants[name])
+	}
+	return nss
+}
+
+// hashOf returns the link hash of the file at remote in ns, or an empty
+// string if it isn't a link.
+func (ns *namespace) hashOf(remote string) string {
+	if ns.linkFs == nil {
+		return path.Base(remote)
+	}
+	return ns.linkFs.HashOf(remote)
+}
+
+// stat returns the node at remote in the VFS of ns. The VFS caches
+// directory listings, so if a registered link is not found the
+// directories leading to it are read again, as they may have been
+// listed before it was registered.
+func (ns *namespace) stat(remote string) (vfs.Node, error) {
+	node, err := ns.vfs.Stat(remote)
+	fileHash := ns.hashOf(remote)
+	if err != vfs.ENOENT || link.LastError(fileHash) != nil {
+		return node, err
+	}
+	if _, ok := link.Load(fileHash); !ok {
+		return node, err
+	}
+	root, rootErr := ns.vfs.Root()
+	if rootErr != nil {
+		return node, err
+	}
+	for dir := path.Dir(remote); dir != "."; dir = path.Dir(dir) {
+		root.ForgetPath(dir, fs.EntryDirectory)
+	}
+	root.ForgetPath(remote, fs.EntryObject)
+	return ns.vfs.Stat(remote)
+}
+
+// revalidate makes the next stat of remote fetch its metadata from the
+// upstream. The VFS cache drops its data on open if the file changed.
+func (ns *namespace) revalidate(remote string) {
+	if ns.linkFs != nil {
+		ns.linkFs.Revalidate(ns.hashOf(remote))
+	}
+	if root, err := ns.vfs.Root(); err == nil {
+		root.ForgetPath(remote, fs.EntryObject)
+	}
+}
+
+// register maps fileHash to targetURL in ns.
+func (ns *namespace) register(ctx context.Context, fileHash, targetURL string, header http.Header) {
+	if ns.linkFs != nil {
+		ns.linkFs.Register(ctx, fileHash, targetURL, header)
+		return
+	}
+	link.Register(ctx, fileHash, targetURL, header)
+}
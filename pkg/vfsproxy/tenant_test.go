@@ -0,0 +1,118 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTenant(t *testing.T) {
+	good := map[string]tenantSpec{
+		"team-a":           {name: "team-a"},
+		"team-a:10G":       {name: "team-a", maxSize: "10G"},
+		"team-a::24h":      {name: "team-a", maxAge: "24h"},
+		"team-a:10G:1h30m": {name: "team-a", maxSize: "10G", maxAge: "1h30m"},
+	}
+	for spec, want := range good {
+		got, err := parseTenant(spec)
+		if err != nil || got != want {
+			t.Errorf("%q: expected %+v, got %+v, %v", spec, want, got, err)
+		}
+	}
+	for _, spec := range []string{"", "a/b", "..", "ab", "team:1G:1h:x"} {
+		if _, err := parseTenant(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestTenantNamespaces(t *testing.T) {
+	content := bytes.Repeat([]byte("tenant"), 100)
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	opt := DefaultOptions()
+	opt.TenantFrom = "header:X-Tenant"
+	opt.Tenants = []string{"team-a:1M", "team-b"}
+	h := newTestHandler(t, opt)
+
+	serve := func(tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/stream", nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		h.Serve(w, r, upstream.URL+"/file.bin")
+		return w
+	}
+
+	for _, tenant := range []string{"team-a", "team-b"} {
+		if w := serve(tenant); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Fatalf("%s: unexpected response %d with %d bytes", tenant, w.Code, w.Body.Len())
+		}
+		if upstreamHeader.Get("X-Tenant") != "" {
+			t.Errorf("%s: tenant header was sent upstream", tenant)
+		}
+	}
+	if w := serve("team-c"); w.Code != http.StatusForbidden {
+		t.Errorf("expected unknown tenant to be rejected, got %d", w.Code)
+	}
+	if w := serve(""); w.Code != http.StatusForbidden {
+		t.Errorf("expected request without tenant to be rejected, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/stream", nil)
+	if a, b := h.getFileHash(r, "team-a", upstream.URL), h.getFileHash(r, "team-b", upstream.URL); a == b {
+		t.Error("expected tenants not to share cache keys")
+	}
+
+	st := h.Status()
+	a, b := st.Tenants["team-a"], st.Tenants["team-b"]
+	if a == nil || b == nil {
+		t.Fatalf("expected usage of both tenants, got %+v", st.Tenants)
+	}
+	if a.Files != 1 || b.Files != 1 {
+		t.Errorf("expected each tenant to cache its own copy, got %+v and %+v", a, b)
+	}
+	if dataRoot, _ := cacheRoots(diskCache(h.tenants["team-a"].vfs)); filepath.Base(dataRoot) != "team-a" {
+		t.Errorf("expected tenant cache in its own directory, got %s", dataRoot)
+	}
+	if a.Max != 1<<20 || b.Max != 0 || st.Cache.Max != 0 {
+		t.Errorf("unexpected limits %+v, %+v and total %+v", a, b, st.Cache)
+	}
+}
+
+func TestTenantDefault(t *testing.T) {
+	opt := DefaultOptions()
+	opt.TenantFrom = "path"
+	opt.Tenants = []string{"team-a"}
+	opt.TenantDefault = "team-b"
+	opt.FsName = "vfsproxy-" + t.Name()
+	opt.CacheDir = t.TempDir()
+	if _, err := NewHandler(opt); err == nil {
+		t.Error("expected an unconfigured default tenant to be rejected")
+	}
+}
+
+func TestServeLinkRegisteredAfterListing(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader([]byte("data")))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+	for _, name := range []string{"/first", "/second"} {
+		w := httptest.NewRecorder()
+		h.Serve(w, httptest.NewRequest("GET", "/stream", nil), upstream.URL+name)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 despite cached directory listings, got %d", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package vfsproxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/tgdrive/rclone-vfs/pkg/vfsproxy")
+
+// startSpan starts the span name for r. If r does not belong to a trace
+// yet, for example because no tracing middleware runs in front of the
+// handler, the trace context sent by the client is continued.
+func startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx := r.Context()
+	kind := trace.SpanKindInternal
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		kind = trace.SpanKindServer
+		attrs = append(attrs, attribute.String("http.request.method", r.Method))
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		attrs = append(attrs, attribute.String("http.request.header.range", rng))
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	return r.WithContext(ctx), span
+}
+
+// spanError records err on the span in ctx.
+func spanError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
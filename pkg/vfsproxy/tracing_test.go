@@ -0,0 +1,82 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	var (
+		mu           sync.Mutex
+		traceparents []string
+	)
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("Traceparent"))
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+
+	// The client's trace is continued
+	const clientTrace = "0af7651916cd43dd8448eb211c80319c"
+	r := httptest.NewRequest("GET", "/stream", nil)
+	r.Header.Set("Traceparent", "00-"+clientTrace+"-b7ad6b7169203331-01")
+	w := httptest.NewRecorder()
+	h.Serve(w, r, upstream.URL+"/file.bin")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	h.Shutdown()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, stub := range exporter.GetSpans() {
+		span := stub.Snapshot()
+		spans[span.Name()] = span
+		if got := span.SpanContext().TraceID().String(); got != clientTrace {
+			t.Errorf("span %q has trace %s, expected %s", span.Name(), got, clientTrace)
+		}
+	}
+	for _, name := range []string{"vfsproxy.Serve", "vfsproxy.ServeFile", "vfs.Stat", "link.fetchMetadata", "HTTP HEAD", "HTTP GET"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("missing span %q, got %v", name, exporter.GetSpans())
+		}
+	}
+	if serve := spans["vfsproxy.Serve"]; serve != nil && serve.SpanKind() != trace.SpanKindServer {
+		t.Errorf("expected server span, got %v", serve.SpanKind())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traceparents) == 0 {
+		t.Fatal("upstream was not called")
+	}
+	for _, tp := range traceparents {
+		if len(tp) != 55 || tp[3:35] != clientTrace {
+			t.Errorf("expected trace context to be propagated upstream, got %q", tp)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package vfsproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/ranges"
+	"github.com/rclone/rclone/vfs/vfscache"
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+// VerifyReport summarises a scrub of the disk cache.
+type VerifyReport struct {
+	Checked int      `json:"checked"`
+	Skipped int      `json:"skipped"`
+	Evicted []string `json:"evicted"`
+}
+
+// Verify walks the disk cache and evicts every fully downloaded file
+// whose data no longer matches a checksum known for it, either from the
+// upstream or computed while downloading. Files which are partially
+// cached, open or have no known checksum are skipped. With tenants the
+// cache of each is checked and evicted files are named below the
+// tenant's directory.
+func (h *Handler) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{Evicted: []string{}}
+	var checked bool
+	for _, ns := range h.namespaces() {
+		c := diskCache(ns.vfs)
+		if c == nil {
+			continue
+		}
+		checked = true
+		if err := verifyCache(ctx, ns, c, report); err != nil {
+			return report, err
+		}
+	}
+	if !checked {
+		return nil, errors.New("vfs cache is disabled")
+	}
+	return report, nil
+}
+
+// verifyCache verifies the files in c, the cache of ns, adding them to
+// report.
+func verifyCache(ctx context.Context, ns *namespace, c *vfscache.Cache, report *VerifyReport) error {
+	dataRoot, _ := cacheRoots(c)
+	return filepath.Walk(dataRoot, func(osPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dataRoot, osPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		ok, err := verifyItem(ns, c, name, osPath)
+		switch {
+		case errors.Is(err, errSkipVerify):
+			report.Skipped++
+		case err != nil:
+			fs.Errorf(name, "vfs cache: verify failed: %v", err)
+			report.Skipped++
+		case ok:
+			report.Checked++
+		default:
+			report.Checked++
+			if c.InUse(name) {
+				fs.Errorf(name, "vfs cache: cached data is corrupt but the file is in use")
+				break
+			}
+			fs.Errorf(name, "vfs cache: evicting as cached data does not match checksum")
+			c.Remove(name)
+			report.Evicted = append(report.Evicted, path.Join(ns.name, name))
+		}
+		return nil
+	})
+}
+
+var errSkipVerify = errors.New("not verifiable")
+
+// verifyItem checks the cached data at osPath against the checksums
+// known for name. It returns errSkipVerify if the item can't be checked.
+func verifyItem(ns *namespace, c *vfscache.Cache, name, osPath string) (bool, error) {
+	if c.InUse(name) {
+		return false, errSkipVerify
+	}
+	info, err := readCacheInfo(c, name)
+	if err != nil {
+		return false, err
+	}
+	if !info.Rs.Present(ranges.Range{Pos: 0, Size: info.Size}) {
+		return false, errSkipVerify
+	}
+
+	want := link.Hashes(ns.hashOf(name))
+	if want == nil {
+		want = make(map[hash.Type]string)
+	}
+	// The fingerprint ends with the MD5 of the object when the upstream
+	// supplied one, which lets files be checked after a restart.
+	if _, ok := want[hash.MD5]; !ok {
+		parts := strings.Split(info.Fingerprint, ",")
+		if sum := parts[len(parts)-1]; len(parts) > 2 && len(sum) == hash.Width(hash.MD5, false) {
+			want[hash.MD5] = sum
+		}
+	}
+	if len(want) == 0 {
+		return false, errSkipVerify
+	}
+
+	var types hash.Set
+	for ht := range want {
+		types.Add(ht)
+	}
+	hasher, err := hash.NewMultiHasherTypes(types)
+	if err != nil {
+		return false, err
+	}
+	in, err := os.Open(osPath)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	if _, err := io.CopyN(hasher, in, info.Size); err != nil {
+		return false, err
+	}
+	for ht, sum := range hasher.Sums() {
+		if !strings.EqualFold(sum, want[ht]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
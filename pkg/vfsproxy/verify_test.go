@@ -0,0 +1,73 @@
+package vfsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tgdrive/rclone-vfs/backend/link"
+)
+
+func newTestHandler(t *testing.T, opt Options) *Handler {
+	t.Helper()
+	opt.FsName = "vfsproxy-" + t.Name()
+	opt.CacheDir = t.TempDir()
+	opt.CacheMode = "full"
+	h, err := NewHandler(opt)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	t.Cleanup(h.Shutdown)
+	return h
+}
+
+func TestVerifyEvictsCorruptData(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := md5.Sum(content)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, DefaultOptions())
+
+	r := httptest.NewRequest("GET", "/stream", nil)
+	w := httptest.NewRecorder()
+	h.Serve(w, r, upstream.URL+"/file.bin")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("unexpected response %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	report, err := h.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if report.Checked != 1 || len(report.Evicted) != 0 {
+		t.Fatalf("expected one clean file, got %+v", report)
+	}
+
+	dataRoot, _ := cacheRoots(diskCache(h.VFS))
+	name := filepath.Join(dataRoot, filepath.FromSlash(link.ShardedPath(h.getFileHash(r, "", upstream.URL+"/file.bin"), h.shardLevel)))
+	if err := os.WriteFile(name, bytes.Repeat([]byte("x"), len(content)), 0600); err != nil {
+		t.Fatalf("failed to corrupt cache file: %v", err)
+	}
+
+	report, err = h.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if len(report.Evicted) != 1 {
+		t.Fatalf("expected corrupt file to be evicted, got %+v", report)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected cache file to be removed, got %v", err)
+	}
+}
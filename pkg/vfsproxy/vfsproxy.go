@@ -3,15 +3,19 @@ package vfsproxy
 import (
 	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	_ "github.com/rclone/rclone/backend/local"
 	"github.com/rclone/rclone/fs"
@@ -22,6 +26,9 @@ import (
 	"github.com/rclone/rclone/vfs/vfscommon"
 	"github.com/spf13/pflag"
 	"github.com/tgdrive/rclone-vfs/backend/link"
+	"github.com/tgdrive/rclone-vfs/pkg/auth"
+	"github.com/tgdrive/rclone-vfs/pkg/evict"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Options struct {
@@ -29,11 +36,68 @@ type Options struct {
 	CacheDir          string `vfs:"-" flag:"cache-dir" caddy:"cache_dir" help:"Cache directory"`
 	CacheMaxAge       string `vfs:"vfs_cache_max_age" flag:"max-age" caddy:"max_age" help:"Max age of files in cache"`
 	CacheMaxSize      string `vfs:"vfs_cache_max_size" flag:"max-size" caddy:"max_size" help:"Max total size of objects in cache"`
+	CachePolicy       string `vfs:"-" flag:"cache-policy" caddy:"cache_policy" help:"Policy evicting files over the max size: lru, lfu, gdsf or tinylfu, or empty for rclone's oldest access first"`
 	CacheChunkSize    string `vfs:"vfs_read_chunk_size" flag:"chunk-size" caddy:"chunk_size" help:"Default Chunk size of read request"`
 	CacheChunkStreams int    `vfs:"vfs_read_chunk_streams" flag:"chunk-streams" caddy:"chunk_streams" help:"The number of parallel streams to read at once"`
 	StripQuery        bool   `vfs:"-" flag:"strip-query" caddy:"strip_query" help:"Strip query parameters from URL for caching"`
 	StripDomain       bool   `vfs:"-" flag:"strip-domain" caddy:"strip_domain" help:"Strip domain and protocol from URL for caching"`
 	ShardLevel        int    `vfs:"-" flag:"shard-level" caddy:"shard-level" help:"Number of shard levels" default:"1"`
+	Dedup             bool   `vfs:"-" flag:"dedup" caddy:"dedup" help:"Serve URLs with identical upstream content from one cache entry"`
+	HashOnDownload    bool   `vfs:"-" flag:"hash-on-download" caddy:"hash_on_download" help:"Compute the MD5 of files downloaded in full so verify can check them"`
+	FilenameParam     string `vfs:"-" flag:"filename-param" caddy:"filename_param" help:"Query parameter that overrides the download filename, e.g. filename"`
+	KeepFilename      bool   `vfs:"-" flag:"keep-filename" caddy:"keep_filename" help:"Include the file name from the URL in the virtual path"`
+	CacheHeader       bool   `vfs:"-" flag:"cache-header" caddy:"cache_header" help:"Report in X-Cache and Cache-Status headers whether responses came from the cache"`
+
+	// Cache key policy
+	KeyKeepQuery []string `vfs:"-" flag:"key-keep-query" caddy:"key_keep_query" help:"Only keep these query parameters in the cache key (repeatable)"`
+	KeyDropQuery []string `vfs:"-" flag:"key-drop-query" caddy:"key_drop_query" help:"Drop these query parameters from the cache key (repeatable)"`
+	KeyRewrite   []string `vfs:"-" flag:"key-rewrite" caddy:"key_rewrite" help:"Regex rewrite of the URL before hashing, as pattern=>replacement (repeatable)"`
+	KeyHeaders   []string `vfs:"-" flag:"key-header" caddy:"key_headers" help:"Include this request header in the cache key (repeatable)"`
+
+	// Negative caching of upstream failures
+	NegativeTTLNotFound  string `vfs:"-" flag:"negative-ttl-not-found" caddy:"negative_ttl_not_found" help:"How long to remember upstream 404 and 410 responses" default:"30s"`
+	NegativeTTLForbidden string `vfs:"-" flag:"negative-ttl-forbidden" caddy:"negative_ttl_forbidden" help:"How long to remember upstream 401 and 403 responses" default:"10s"`
+	NegativeTTLError     string `vfs:"-" flag:"negative-ttl-error" caddy:"negative_ttl_error" help:"How long to remember rate limits, timeouts and other upstream errors" default:"5s"`
+
+	// Cross-origin requests from browser based players
+	CORSOrigins       []string `vfs:"-" flag:"cors-origin" caddy:"cors_origins" help:"Allow cross-origin requests from this origin, * for any (repeatable)"`
+	CORSAllowHeaders  []string `vfs:"-" flag:"cors-allow-header" caddy:"cors_allow_headers" help:"Request header cross-origin requests may send (repeatable)" default:"Range,If-Range,If-Modified-Since,If-None-Match,Authorization"`
+	CORSExposeHeaders []string `vfs:"-" flag:"cors-expose-header" caddy:"cors_expose_headers" help:"Response header exposed to cross-origin requests (repeatable)" default:"Content-Range,Accept-Ranges,Content-Length,Content-Disposition,X-Cache,Cache-Status,Age"`
+	CORSCredentials   bool     `vfs:"-" flag:"cors-credentials" caddy:"cors_credentials" help:"Allow cross-origin requests with credentials"`
+	CORSMaxAge        string   `vfs:"-" flag:"cors-max-age" caddy:"cors_max_age" help:"How long browsers may cache preflight responses" default:"10m"`
+
+	// Authentication of clients
+	AuthTokens      []string `vfs:"-" flag:"auth-token" caddy:"auth_tokens" help:"Accept this bearer token, as name:token (repeatable)"`
+	AuthHtpasswd    string   `vfs:"-" flag:"auth-htpasswd" caddy:"auth_htpasswd" help:"Accept HTTP basic credentials from this htpasswd file"`
+	AuthJWKS        string   `vfs:"-" flag:"auth-jwks" caddy:"auth_jwks" help:"Accept JWTs signed by a key in this JWKS file"`
+	AuthJWTIssuer   string   `vfs:"-" flag:"auth-jwt-issuer" caddy:"auth_jwt_issuer" help:"Required issuer of JWTs"`
+	AuthJWTAudience string   `vfs:"-" flag:"auth-jwt-audience" caddy:"auth_jwt_audience" help:"Required audience of JWTs"`
+	AuthHostsClaim  string   `vfs:"-" flag:"auth-hosts-claim" caddy:"auth_hosts_claim" help:"JWT claim listing the upstream hosts the token may fetch from" default:"allowed_hosts"`
+	AuthAllowHosts  []string `vfs:"-" flag:"auth-allow-hosts" caddy:"auth_allow_hosts" help:"Restrict an identity to these upstream hosts, as name=host1,host2 (repeatable)"`
+
+	// Tenant namespaces with their own cache
+	TenantFrom    string   `vfs:"-" flag:"tenant-from" caddy:"tenant_from" help:"Derive the tenant of a request from the auth identity (identity), a request header (header:X-Tenant) or the {tenant} path segment (path)"`
+	Tenants       []string `vfs:"-" flag:"tenant" caddy:"tenants" help:"Tenant with its own cache, as name[:max-size[:max-age]] (repeatable)"`
+	TenantDefault string   `vfs:"-" flag:"tenant-default" caddy:"tenant_default" help:"Tenant serving requests which name none, otherwise they are rejected"`
+
+	// Files kept in the cache
+	Pins    []string `vfs:"-" flag:"pin" caddy:"pins" help:"Keep this URL or link hash in the cache, as [tenant ]target (repeatable)"`
+	PinFile string   `vfs:"-" flag:"pin-file" caddy:"pin_file" help:"File of URLs or link hashes to keep in the cache, one per line, updated by the admin API"`
+
+	// Freshness headers for downstream caches
+	CacheControl []string `vfs:"-" flag:"cache-control" caddy:"cache_control" help:"Cache-Control header of files from matching upstream URLs instead of the upstream's, as host[/path]=value where * matches anything (repeatable)"`
+
+	// Upstream response headers replayed to clients
+	PassHeaders []string `vfs:"-" flag:"pass-header" caddy:"pass_headers" help:"Upstream response header to pass to clients, e.g. Content-Language, or a prefix like X-Amz-Meta-* (repeatable)"`
+
+	// Files streamed without entering the cache
+	AdmitMinSize string   `vfs:"-" flag:"admit-min-size" caddy:"admit_min_size" help:"Don't cache files smaller than this"`
+	AdmitMaxSize string   `vfs:"-" flag:"admit-max-size" caddy:"admit_max_size" help:"Don't cache files larger than this or of unknown size"`
+	AdmitTypes   []string `vfs:"-" flag:"admit-type" caddy:"admit_types" help:"Only cache files whose content type matches this pattern, e.g. video/* (repeatable)"`
+	BypassHosts  []string `vfs:"-" flag:"bypass-host" caddy:"bypass_hosts" help:"Don't cache files from hosts matching this pattern, e.g. *.example.com (repeatable)"`
+
+	// Streaming manifests
+	RewriteManifests bool `vfs:"-" flag:"rewrite-manifests" caddy:"rewrite_manifests" help:"Rewrite the URIs in HLS and DASH manifests so segments are fetched through the proxy"`
 
 	// Additional VFS Options
 	CacheMode         string `vfs:"vfs_cache_mode" flag:"cache-mode" caddy:"cache_mode" help:"VFS cache mode (off, minimal, writes, full)"`
@@ -71,6 +135,9 @@ func (opt *Options) AddFlags(fs *pflag.FlagSet) {
 			fs.IntVar(f.Addr().Interface().(*int), flagName, int(f.Int()), help)
 		case reflect.Bool:
 			fs.BoolVar(f.Addr().Interface().(*bool), flagName, f.Bool(), help)
+		case reflect.Slice:
+			ptr := f.Addr().Interface().(*[]string)
+			fs.StringArrayVar(ptr, flagName, *ptr, help)
 		}
 	}
 }
@@ -122,6 +189,8 @@ func DefaultOptions() Options {
 			}
 		case reflect.Bool:
 			f.SetBool(def == "true")
+		case reflect.Slice:
+			f.Set(reflect.ValueOf(strings.Split(def, ",")))
 		}
 	}
 
@@ -157,33 +226,138 @@ func DefaultOptions() Options {
 	return opt
 }
 
+// KeyFunc returns the cache key for a request to targetURL. Requests
+// that map to the same key share one cache entry.
+type KeyFunc func(r *http.Request, targetURL string) string
+
+// ManifestURLFunc returns the URL a manifest rewritten for request r
+// refers to targetURL by. If template is true, targetURL is a DASH
+// segment template whose $...$ identifiers must be kept as they are.
+type ManifestURLFunc func(r *http.Request, targetURL string, template bool) string
+
 type Handler struct {
-	VFS         *vfs.VFS
-	mu          sync.RWMutex
-	hashCache   map[string]string
-	stripQuery  bool
-	stripDomain bool
-	shardLevel  int
+	// VFS serves requests. With tenants it is the VFS of the default
+	// tenant, or of the first one configured.
+	VFS *vfs.VFS
+
+	// Version is reported by the status endpoint.
+	Version string
+
+	// KeyFunc computes cache keys. NewHandler sets it to apply the key
+	// policy from Options; library users may replace it before serving.
+	KeyFunc KeyFunc
+
+	// ManifestURL builds the URIs of rewritten manifests. NewHandler
+	// sets it to point at the stream endpoint a manifest was fetched
+	// from; library users serving files under other URLs replace it.
+	ManifestURL ManifestURLFunc
+
+	// Auth authenticates clients if set. NewHandler sets it from the
+	// authentication Options.
+	Auth auth.Authenticator
+
+	linkFs        *link.Fs
+	defaultNS     *namespace
+	cachePolicy   string
+	cors          *corsPolicy
+	admission     *admissionPolicy
+	tenants       map[string]*namespace
+	tenantNames   []string
+	tenantFrom    string
+	tenantHeader  string
+	tenantDefault string
+	pins          pinSet
+	mu            sync.RWMutex
+	hashCache     map[string]string
+	shardLevel    int
+	filenameParam string
+	cacheHeader   bool
+	cacheName     string
+	cacheControl  []cacheControlRule
+	passHeaders   []string
+	manifests     bool
+	liveManifests sync.Map // namespace and remote of live manifests to their expiry
+	archives      archiveIndexes
+	started       time.Time
+	draining      atomic.Bool
+	writable      writableCheck
+}
+
+// keyPolicy builds the link.KeyPolicy described by opt.
+func (opt *Options) keyPolicy() (*link.KeyPolicy, error) {
+	p := &link.KeyPolicy{
+		StripQuery:  opt.StripQuery,
+		StripDomain: opt.StripDomain,
+		KeepQuery:   opt.KeyKeepQuery,
+		DropQuery:   opt.KeyDropQuery,
+		Headers:     opt.KeyHeaders,
+	}
+	for _, rule := range opt.KeyRewrite {
+		rw, err := link.ParseRewrite(rule)
+		if err != nil {
+			return nil, err
+		}
+		p.Rewrites = append(p.Rewrites, rw)
+	}
+	return p, nil
 }
 
 func NewHandler(opt Options) (*Handler, error) {
 	ctx := context.Background()
 
+	policy, err := opt.keyPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache key policy: %w", err)
+	}
+	var corsMaxAge time.Duration
+	if opt.CORSMaxAge != "" {
+		if corsMaxAge, err = fs.ParseDuration(opt.CORSMaxAge); err != nil {
+			return nil, fmt.Errorf("invalid CORS max age: %w", err)
+		}
+	}
+	authenticator, err := newAuthenticator(&opt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authentication options: %w", err)
+	}
+	admission, err := newAdmissionPolicy(&opt)
+	if err != nil {
+		return nil, err
+	}
+	cacheControl, err := parseCacheControlRules(opt.CacheControl)
+	if err != nil {
+		return nil, err
+	}
+	passHeaders, err := parsePassHeaders(opt.PassHeaders)
+	if err != nil {
+		return nil, err
+	}
+
 	m := configmap.Simple{
-		"type":         "link",
-		"strip_query":  strconv.FormatBool(opt.StripQuery),
-		"strip_domain": strconv.FormatBool(opt.StripDomain),
-		"shard_level":  strconv.Itoa(opt.ShardLevel),
+		"type":             "link",
+		"strip_query":      strconv.FormatBool(opt.StripQuery),
+		"strip_domain":     strconv.FormatBool(opt.StripDomain),
+		"shard_level":      strconv.Itoa(opt.ShardLevel),
+		"dedup":            strconv.FormatBool(opt.Dedup),
+		"hash_on_download": strconv.FormatBool(opt.HashOnDownload),
+		"keep_filename":    strconv.FormatBool(opt.KeepFilename),
+
+		"negative_ttl_not_found": opt.NegativeTTLNotFound,
+		"negative_ttl_forbidden": opt.NegativeTTLForbidden,
+		"negative_ttl_error":     opt.NegativeTTLError,
 	}
 
-	// Create a new file system for the link backend
-	f, err := fs.NewFs(ctx, opt.FsName+":")
-	if err != nil {
-		// Fallback to manual creation if not in rclone config
-		f, err = link.NewFs(ctx, opt.FsName, "", m)
+	// Create a new file system for the link backend, rooted at the
+	// directory of a tenant if given
+	newFs := func(root string) (fs.Fs, error) {
+		f, err := fs.NewFs(ctx, opt.FsName+":"+root)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create link backend: %w", err)
+			// Fallback to manual creation if not in rclone config
+			f, err = link.NewFs(ctx, opt.FsName, root, m)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create link backend: %w", err)
+			}
 		}
+		return f, nil
 	}
 
 	// Configure VFS options
@@ -203,115 +377,438 @@ func NewHandler(opt Options) (*Handler, error) {
 		return nil, fmt.Errorf("failed to set cache directory: %w", err)
 	}
 
-	vfsInstance := vfs.New(f, &vfsOpt)
-	return &Handler{
-		VFS:         vfsInstance,
-		hashCache:   make(map[string]string),
-		stripQuery:  opt.StripQuery,
-		stripDomain: opt.StripDomain,
-		shardLevel:  opt.ShardLevel,
-	}, nil
+	h := &Handler{
+		KeyFunc: func(r *http.Request, targetURL string) string {
+			return policy.Key(targetURL, r.Header)
+		},
+		ManifestURL:   streamURL,
+		Auth:          authenticator,
+		cors:          newCORSPolicy(&opt, corsMaxAge),
+		admission:     admission,
+		hashCache:     make(map[string]string),
+		shardLevel:    opt.ShardLevel,
+		filenameParam: opt.FilenameParam,
+		cachePolicy:   opt.CachePolicy,
+		cacheHeader:   opt.CacheHeader,
+		cacheName:     cacheStatusName(opt.FsName),
+		cacheControl:  cacheControl,
+		passHeaders:   passHeaders,
+		manifests:     opt.RewriteManifests,
+		archives:      archiveIndexes{dir: filepath.Join(actualCacheDir, "vfsproxyArchives", opt.FsName)},
+		started:       time.Now(),
+	}
+	if h.cachePolicy != "" {
+		if !slices.Contains(evict.Policies, h.cachePolicy) {
+			return nil, fmt.Errorf("invalid cache policy %q: want one of %s", h.cachePolicy, strings.Join(evict.Policies, ", "))
+		}
+		if vfsOpt.CacheMode < vfscommon.CacheModeFull {
+			return nil, errors.New("a cache policy needs cache mode full")
+		}
+	}
+
+	if opt.TenantFrom == "" {
+		if len(opt.Tenants) > 0 {
+			return nil, errors.New("tenants need a tenant source")
+		}
+		f, err := newFs("")
+		if err != nil {
+			return nil, err
+		}
+		linkFs, _ := f.(*link.Fs)
+		if h.defaultNS, err = h.newNamespace("", f, linkFs, vfsOpt); err != nil {
+			h.Shutdown()
+			return nil, err
+		}
+		h.VFS, h.linkFs = h.defaultNS.vfs, linkFs
+		h.archives.start(h)
+		if err := h.startPins(&opt); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	// Every tenant gets a VFS of its own so that one tenant filling its
+	// cache can't evict the files of another
+	if h.tenantFrom, h.tenantHeader, err = tenantSource(opt.TenantFrom); err != nil {
+		return nil, err
+	}
+	if len(opt.Tenants) == 0 {
+		return nil, errors.New("tenant source set but no tenants configured")
+	}
+	var specs []tenantSpec
+	for _, spec := range opt.Tenants {
+		t, err := parseTenant(spec)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(specs, func(other tenantSpec) bool { return other.name == t.name }) {
+			return nil, fmt.Errorf("tenant %q configured twice", t.name)
+		}
+		specs = append(specs, t)
+	}
+	if opt.TenantDefault != "" && !slices.ContainsFunc(specs, func(t tenantSpec) bool { return t.name == opt.TenantDefault }) {
+		return nil, fmt.Errorf("default tenant %q is not configured", opt.TenantDefault)
+	}
+	h.tenantDefault = opt.TenantDefault
+
+	h.tenants = make(map[string]*namespace, len(specs))
+	for _, t := range specs {
+		tenantOpt := vfsOpt
+		if t.maxSize != "" {
+			if err := tenantOpt.CacheMaxSize.Set(t.maxSize); err != nil {
+				h.Shutdown()
+				return nil, fmt.Errorf("invalid max size of tenant %q: %w", t.name, err)
+			}
+		}
+		if t.maxAge != "" {
+			if err := tenantOpt.CacheMaxAge.Set(t.maxAge); err != nil {
+				h.Shutdown()
+				return nil, fmt.Errorf("invalid max age of tenant %q: %w", t.name, err)
+			}
+		}
+		f, err := newFs(t.name)
+		if err != nil {
+			h.Shutdown()
+			return nil, err
+		}
+		linkFs, ok := f.(*link.Fs)
+		if !ok {
+			h.Shutdown()
+			return nil, fmt.Errorf("tenants need a link backend, %s is %s", opt.FsName, f.String())
+		}
+		ns, err := h.newNamespace(t.name, f, linkFs, tenantOpt)
+		if err != nil {
+			h.Shutdown()
+			return nil, fmt.Errorf("tenant %q: %w", t.name, err)
+		}
+		h.tenants[t.name] = ns
+		h.tenantNames = append(h.tenantNames, t.name)
+	}
+	ns := h.tenants[h.tenantNames[0]]
+	if h.tenantDefault != "" {
+		ns = h.tenants[h.tenantDefault]
+	}
+	h.defaultNS, h.VFS, h.linkFs = ns, ns.vfs, ns.linkFs
+	h.archives.start(h)
+	if err := h.startPins(&opt); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// startPins pins the files configured in opt, shutting h down if that
+// fails.
+func (h *Handler) startPins(opt *Options) error {
+	if err := h.initPins(opt); err != nil {
+		h.Shutdown()
+		return fmt.Errorf("invalid pins: %w", err)
+	}
+	return nil
 }
 
 func (h *Handler) Shutdown() {
-	h.VFS.Shutdown()
+	h.closePins()
+	h.archives.close()
+	for _, ns := range h.namespaces() {
+		if ns.evictor != nil {
+			ns.evictor.close()
+		}
+		if ns.vfs != nil {
+			ns.vfs.Shutdown()
+		}
+	}
 }
 
-func (h *Handler) getFileHash(targetURL string) string {
+func (h *Handler) getFileHash(r *http.Request, tenant, targetURL string) string {
+	key := h.KeyFunc(r, targetURL)
+	if tenant != "" {
+		// Tenants don't share cache entries
+		key = tenant + "\x00" + key
+	}
+
 	h.mu.RLock()
-	fileHash, exists := h.hashCache[targetURL]
+	fileHash, exists := h.hashCache[key]
 	h.mu.RUnlock()
 
 	if exists {
 		return fileHash
 	}
 
-	// Apply stripping to the URL before hashing
-	keyURL := link.StripURL(targetURL, h.stripQuery, h.stripDomain)
-
-	hashBytes := md5.Sum([]byte(keyURL))
+	hashBytes := md5.Sum([]byte(key))
 	computedHash := fmt.Sprintf("%x", hashBytes)
 
 	// Double-checked locking to avoid duplicate computation
 	h.mu.Lock()
-	if fileHash, exists = h.hashCache[targetURL]; exists {
+	if fileHash, exists = h.hashCache[key]; exists {
 		h.mu.Unlock()
 		return fileHash
 	}
-	h.hashCache[targetURL] = computedHash
+	h.hashCache[key] = computedHash
 	h.mu.Unlock()
 
 	return computedHash
 }
 
 func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string) {
+	h.serveLink(w, r, targetURL, "vfsproxy.Serve", func(r *http.Request, remote string) {
+		h.ServeFile(w, r, remote)
+	})
+}
+
+// serveLink authenticates r and registers targetURL in the namespace r
+// belongs to, then calls serve with the path of the link in its VFS
+// within a span named spanName.
+func (h *Handler) serveLink(w http.ResponseWriter, r *http.Request, targetURL, spanName string, serve func(r *http.Request, remote string)) {
+	if h.ServeCORS(w, r) {
+		return
+	}
+	if h.Auth != nil {
+		id, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+		r = r.WithContext(auth.NewContext(r.Context(), id))
+	}
 	if targetURL == "" {
-		http.Error(w, "Target URL is required", http.StatusBadRequest)
+		WriteError(w, r, http.StatusBadRequest, "Target URL is required")
+		return
+	}
+	if id := auth.FromContext(r.Context()); id != nil && !hostAllowed(id, targetURL) {
+		WriteError(w, r, http.StatusForbidden, "Upstream host not allowed")
+		return
+	}
+	ns, err := h.namespaceFor(r)
+	if err != nil {
+		msg := "Unknown tenant"
+		if errors.Is(err, errTenantRequired) {
+			msg = "Tenant required"
+		}
+		WriteError(w, r, http.StatusForbidden, msg)
 		return
 	}
+	r = r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns))
 
-	fileHash := h.getFileHash(targetURL)
+	fileHash := h.getFileHash(r, ns.name, targetURL)
 
-	link.Register(fileHash, targetURL, r.Header.Clone())
+	r, span := startSpan(r, spanName, attribute.String("link.hash", fileHash))
+	defer span.End()
+	if ns.name != "" {
+		span.SetAttributes(attribute.String("vfsproxy.tenant", ns.name))
+	}
+
+	header := upstreamHeader(r.Header)
+	if h.Auth != nil {
+		// Our credentials are not meant for the upstream
+		header.Del("Authorization")
+	}
+	if h.tenantHeader != "" {
+		header.Del(h.tenantHeader)
+	}
+	ns.register(r.Context(), fileHash, targetURL, header)
+	if id := auth.FromContext(r.Context()); id != nil {
+		link.AllowRedirects(fileHash, id.AllowsHost)
+	}
+	h.activatePin(ns, fileHash)
+	if ns.linkFs != nil {
+		fileHash = ns.linkFs.Canonical(r.Context(), fileHash)
+	}
+	if info := accessInfoFrom(r.Context()); info != nil {
+		info.url = targetURL
+		info.hash = fileHash
+		info.tenant = ns.name
+	}
 
-	h.ServeFile(w, r, link.ShardedPath(fileHash, h.shardLevel))
+	serve(r, h.remotePath(ns, fileHash))
 }
 
-func (h *Handler) ServeFile(w http.ResponseWriter, r *http.Request, remote string) {
-	ctx := r.Context()
-	node, err := h.VFS.Stat(remote)
+// hopByHopHeaders apply to the connection of the client rather than
+// the request, so they are not sent on to the upstream.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upstreamHeader returns the header of a client request to send to the
+// upstream: without hop-by-hop headers, those the client listed in
+// Connection, and cookies, which are scoped to the domain of the proxy.
+func upstreamHeader(in http.Header) http.Header {
+	header := in.Clone()
+	for _, v := range in.Values("Connection") {
+		for name := range strings.SplitSeq(v, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	header.Del("Cookie")
+	return header
+}
+
+// remotePath returns the path of the registered link fileHash in the
+// VFS of ns.
+func (h *Handler) remotePath(ns *namespace, fileHash string) string {
+	if ns.linkFs != nil {
+		return ns.linkFs.VirtualPath(fileHash)
+	}
+	return link.ShardedPath(fileHash, h.shardLevel)
+}
+
+// lookup returns the file at remote in ns and its object, or replies
+// with an error and returns false if there is none.
+func lookup(w http.ResponseWriter, r *http.Request, ns *namespace, remote string) (*vfs.File, fs.Object, bool) {
+	_, statSpan := tracer.Start(r.Context(), "vfs.Stat")
+	node, err := ns.stat(remote)
+	statSpan.End()
 	if err == vfs.ENOENT {
-		fs.Infof(remote, "%s: File not found", r.RemoteAddr)
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, "Failed to find file: "+err.Error(), http.StatusInternalServerError)
-		return
+		// The backend hides links whose metadata fetch failed, so
+		// report the upstream failure instead of a bare not found.
+		if upstreamErr := link.LastError(ns.hashOf(remote)); upstreamErr != nil {
+			err = upstreamErr
+		}
+	}
+	if err != nil {
+		serveError(w, r, remote, err)
+		return nil, nil, false
 	}
 	if !node.IsFile() {
-		http.Error(w, "Not a file", http.StatusNotFound)
-		return
+		WriteError(w, r, http.StatusNotFound, "Not a file")
+		return nil, nil, false
 	}
 
 	entry := node.DirEntry()
 	if entry == nil {
-		http.Error(w, "Can't open file being written", http.StatusNotFound)
+		WriteError(w, r, http.StatusNotFound, "Can't open file being written")
+		return nil, nil, false
+	}
+	return node.(*vfs.File), entry.(fs.Object), true
+}
+
+func (h *Handler) ServeFile(w http.ResponseWriter, r *http.Request, remote string) {
+	r, span := startSpan(r, "vfsproxy.ServeFile", attribute.String("vfs.remote", remote))
+	defer span.End()
+
+	ctx := r.Context()
+	ns := h.namespace(ctx)
+	directives := parseClientDirectives(r)
+	if directives.onlyIfCached {
+		// Don't ask the upstream about files which were never cached.
+		// Cached ones are still looked up, which validates them with a
+		// HEAD request unless their metadata was fetched moments ago;
+		// their content then comes from the cache alone.
+		if c := diskCache(ns.vfs); c == nil || !isCached(c, remote) {
+			WriteError(w, r, http.StatusGatewayTimeout, "Not cached")
+			return
+		}
+	} else if directives.noCache || h.manifestExpired(ns, remote) {
+		ns.revalidate(remote)
+	}
+	file, obj, ok := lookup(w, r, ns, remote)
+	if !ok {
+		return
+	}
+
+	if directives.onlyIfCached && cacheSource(ns.vfs, remote, requestRange(r.Header.Get("Range"), file.Size())) != sourceCache {
+		WriteError(w, r, http.StatusGatewayTimeout, "Not cached")
 		return
 	}
-	obj := entry.(fs.Object)
-	file := node.(*vfs.File)
 
 	knownSize := obj.Size() >= 0
 	if knownSize {
-		w.Header().Set("Content-Length", strconv.FormatInt(node.Size(), 10))
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size(), 10))
 	}
 
-	mimeType := fs.MimeType(ctx, obj)
-	if mimeType == "application/octet-stream" && path.Ext(remote) == "" {
-	} else {
-		w.Header().Set("Content-Type", mimeType)
-	}
+	h.setPassedHeaders(w, obj)
+	h.setContentHeaders(ctx, w, r, obj, remote)
+	h.setFreshnessHeaders(w, ns, obj, remote)
 	w.Header().Set("Last-Modified", file.ModTime().UTC().Format(http.TimeFormat))
+	kind := h.manifestKind(w, ns, obj, remote)
+	if kind != "" {
+		// The rewritten manifest has a length of its own
+		w.Header().Del("Content-Length")
+	}
 
 	if r.Method == "HEAD" {
+		if h.cacheHeader {
+			h.setCacheStatus(w, cacheSource(ns.vfs, remote, requestRange(r.Header.Get("Range"), file.Size())))
+		}
 		return
 	}
 
+	info := accessInfoFrom(ctx)
+	if info != nil && knownSize {
+		info.size = file.Size()
+	}
+
+	// Files the client, the admission rules or the cache policy keep
+	// out of the cache are streamed from the upstream
+	if directives.noStore || !h.admit(ctx, ns, remote, obj) {
+		span.SetAttributes(attribute.String("vfsproxy.source", sourceBypass))
+		if info != nil {
+			info.source = sourceBypass
+		}
+		if h.cacheHeader {
+			h.setCacheStatus(w, sourceBypass)
+		}
+		if kind != "" {
+			in, err := obj.Open(ctx)
+			if err != nil {
+				serveError(w, r, remote, err)
+				return
+			}
+			defer func() {
+				_ = in.Close()
+			}()
+			h.serveManifest(w, r, ns, remote, kind, file.ModTime(), in)
+			return
+		}
+		servePassThrough(w, r, obj, remote, file.ModTime())
+		return
+	}
+
+	if info != nil || span.IsRecording() || h.cacheHeader {
+		source := cacheSource(ns.vfs, remote, requestRange(r.Header.Get("Range"), file.Size()))
+		span.SetAttributes(attribute.String("vfsproxy.source", source))
+		if info != nil {
+			info.source = source
+		}
+		if h.cacheHeader {
+			h.setCacheStatus(w, source)
+		}
+	}
+
 	// open the object
+	_, openSpan := tracer.Start(ctx, "vfs.Open")
 	in, err := file.Open(os.O_RDONLY)
+	openSpan.End()
 	if err != nil {
-		http.Error(w, "Failed to open file: "+err.Error(), http.StatusInternalServerError)
+		serveError(w, r, remote, err)
 		return
 	}
 	defer func() {
 		_ = in.Close()
+		if ns.evictor != nil {
+			// Eviction skips open files
+			ns.evictor.wake()
+		}
 	}()
 
+	if kind != "" {
+		h.serveManifest(w, r, ns, remote, kind, file.ModTime(), in)
+		return
+	}
 	if knownSize {
 		http.ServeContent(w, r, remote, file.ModTime(), in)
 	} else {
 		if rangeRequest := r.Header.Get("Range"); rangeRequest != "" {
-			http.Error(w, "Can't use Range: on files of unknown length", http.StatusRequestedRangeNotSatisfiable)
+			WriteError(w, r, http.StatusRequestedRangeNotSatisfiable, "Can't use Range: on files of unknown length")
 			return
 		}
 		n, err := io.Copy(w, in)
@@ -0,0 +1,77 @@
+package vfsproxy
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// serveZip serves member of the ZIP archive a, or lists its members if
+// member is empty. Only the central directory and the member are read.
+// Stored members support Range requests, deflated ones are streamed.
+func (h *Handler) serveZip(w http.ResponseWriter, r *http.Request, a *archive, member string) {
+	zr, err := zip.NewReader(a.in, a.file.Size())
+	if errors.Is(err, zip.ErrFormat) {
+		WriteError(w, r, http.StatusBadGateway, "Not a ZIP archive")
+		return
+	}
+	if err != nil {
+		serveError(w, r, a.remote, err)
+		return
+	}
+
+	if member == "" {
+		members := make([]ArchiveMember, 0, len(zr.File))
+		for _, f := range zr.File {
+			members = append(members, ArchiveMember{
+				Name:     f.Name,
+				Size:     int64(f.UncompressedSize64),
+				Modified: f.Modified,
+				Dir:      f.FileInfo().IsDir(),
+			})
+		}
+		writeJSON(w, members)
+		return
+	}
+
+	var f *zip.File
+	for _, zf := range zr.File {
+		if zf.Name == member {
+			f = zf
+			break
+		}
+	}
+	if f == nil || f.FileInfo().IsDir() {
+		WriteError(w, r, http.StatusNotFound, "Member not found")
+		return
+	}
+	if f.Flags&0x1 != 0 {
+		WriteError(w, r, http.StatusNotImplemented, "Encrypted members are not supported")
+		return
+	}
+
+	if f.Method == zip.Store {
+		offset, err := f.DataOffset()
+		if err != nil {
+			serveError(w, r, a.remote, err)
+			return
+		}
+		setMemberHeaders(w, f.Name)
+		http.ServeContent(w, r, f.Name, f.Modified, io.NewSectionReader(a.in, offset, int64(f.CompressedSize64)))
+		return
+	}
+	in, err := f.Open()
+	if errors.Is(err, zip.ErrAlgorithm) {
+		WriteError(w, r, http.StatusNotImplemented, "Unsupported compression method")
+		return
+	}
+	if err != nil {
+		serveError(w, r, a.remote, err)
+		return
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	serveMemberStream(w, r, a, f.Name, int64(f.UncompressedSize64), f.Modified, in)
+}
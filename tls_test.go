@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, cert tls.Certificate, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first, err := selfSignedCert("first.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, first, certFile, keyFile, time.Now().Add(-time.Hour))
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := selfSignedCert("second.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, second, certFile, keyFile, time.Now())
+
+	// Changes are only noticed after certCheckInterval
+	got, _ := r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], first.Certificate[0]) {
+		t.Fatal("expected the first certificate before the check interval")
+	}
+	r.checked = time.Time{}
+	got, _ = r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], second.Certificate[0]) {
+		t.Fatal("expected the certificate to be reloaded")
+	}
+
+	// A broken key keeps the previous certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.checked = time.Time{}
+	got, _ = r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], second.Certificate[0]) {
+		t.Fatal("expected the previous certificate to be kept")
+	}
+}